@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/shirou/gopsutil/process"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ProcessWatchInterval is how often the processes are matched again to
+// attach the ones started during the record.
+const ProcessWatchInterval = time.Second
+
+// CgroupRoot is where the cgroup hierarchies are mounted, the --cgroup
+// paths are relative to it.
+const CgroupRoot = "/sys/fs/cgroup"
+
+var pidNsRegexp = regexp.MustCompile(`^pid:\[\d+\]$`)
+
+// processMatcher selects the record targets by name, cgroup or pid
+// namespace, the criteria set must all match.
+type processMatcher struct {
+	Name   string
+	Cgroup string
+	PidNs  string
+}
+
+// newProcessMatcher normalizes the criteria. The cgroup is a directory of
+// CgroupRoot or a path as listed in /proc/pid/cgroup, the pid namespace
+// is "pid:[inode]", the bare inode or a /proc/pid/ns/pid link.
+func newProcessMatcher(name string, cgroup string, pidNs string) (*processMatcher, error) {
+	m := &processMatcher{Name: name}
+	if len(cgroup) > 0 {
+		m.Cgroup = strings.TrimSuffix(strings.TrimPrefix(cgroup, CgroupRoot), "/")
+		if len(m.Cgroup) == 0 {
+			m.Cgroup = "/"
+		}
+	}
+	if len(pidNs) > 0 {
+		if strings.HasPrefix(pidNs, "/") {
+			link, err := os.Readlink(pidNs)
+			if err != nil {
+				return nil, fmt.Errorf("read pid namespace error: %w", err)
+			}
+			pidNs = link
+		} else if !strings.HasPrefix(pidNs, "pid:") {
+			pidNs = "pid:[" + pidNs + "]"
+		}
+		if !pidNsRegexp.MatchString(pidNs) {
+			return nil, fmt.Errorf("invalid pid namespace: %s", pidNs)
+		}
+		m.PidNs = pidNs
+	}
+	return m, nil
+}
+
+func (m *processMatcher) empty() bool {
+	return len(m.Name) == 0 && len(m.Cgroup) == 0 && len(m.PidNs) == 0
+}
+
+func (m *processMatcher) String() string {
+	var criteria []string
+	if len(m.Name) > 0 {
+		criteria = append(criteria, "name "+m.Name)
+	}
+	if len(m.Cgroup) > 0 {
+		criteria = append(criteria, "cgroup "+m.Cgroup)
+	}
+	if len(m.PidNs) > 0 {
+		criteria = append(criteria, "pid namespace "+m.PidNs)
+	}
+	return strings.Join(criteria, ", ")
+}
+
+func (m *processMatcher) match(p *process.Process) bool {
+	if len(m.Name) > 0 && !IsProcessNamed(p, m.Name) {
+		return false
+	}
+	if len(m.Cgroup) > 0 && !isProcessInCgroup(p.Pid, m.Cgroup) {
+		return false
+	}
+	if len(m.PidNs) > 0 {
+		link, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/pid", p.Pid))
+		if err != nil || link != m.PidNs {
+			return false
+		}
+	}
+	return true
+}
+
+// findPids returns the matching processes, except ours and the tracers we
+// run, which may share the cgroup or namespace of the targets.
+func (m *processMatcher) findPids() []int32 {
+	var pids []int32
+	processes, _ := process.Processes()
+	for _, p := range processes {
+		if m.match(p) && !isOwnProcess(p) {
+			pids = append(pids, p.Pid)
+		}
+	}
+	return pids
+}
+
+func isOwnProcess(p *process.Process) bool {
+	self := int32(os.Getpid())
+	for pid := p.Pid; pid > 1; {
+		if pid == self {
+			return true
+		}
+		ppid, err := (&process.Process{Pid: pid}).Ppid()
+		if err != nil {
+			return false
+		}
+		pid = ppid
+	}
+	return false
+}
+
+// isProcessInCgroup tells whether the process is in the cgroup or below
+// it. A cgroup v1 path may start with its controller, as in
+// /memory/docker/id.
+func isProcessInCgroup(pid int32, cgroup string) bool {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return false
+	}
+	under := func(path string) bool {
+		return cgroup == "/" || path == cgroup || strings.HasPrefix(path, cgroup+"/")
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if under(fields[2]) {
+			return true
+		}
+		for _, controller := range strings.Split(fields[1], ",") {
+			if under("/" + strings.TrimPrefix(controller, "name=") + fields[2]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// watchProcesses attaches the tracer to the processes matching from now
+// on, until stop is closed. The pids of known are attached already. The
+// children of known processes are left to the tracer when it follows
+// them.
+func watchProcesses(m *processMatcher, known []int32, tracer Tracer, followChildren bool, stop <-chan struct{}) {
+	attached := make(map[int32]bool)
+	for _, pid := range known {
+		attached[pid] = true
+	}
+	ticker := time.NewTicker(ProcessWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		var pids []int32
+		for _, pid := range m.findPids() {
+			if attached[pid] {
+				continue
+			}
+			if followChildren {
+				if ppid, err := (&process.Process{Pid: pid}).Ppid(); err == nil && attached[ppid] {
+					attached[pid] = true
+					continue
+				}
+			}
+			pids = append(pids, pid)
+		}
+		if len(pids) == 0 {
+			continue
+		}
+		err := tracer.Attach(pids)
+		if err != nil {
+			PrintVerboseInfo("attach process %v: %v", pids, err)
+			continue
+		}
+		for _, pid := range pids {
+			attached[pid] = true
+		}
+		PrintVerboseInfo("attach process %v", pids)
+	}
+}
+
+// resolveRecordTargets returns the pids given and the matching processes.
+func resolveRecordTargets(processes []string, m *processMatcher) ([]int32, error) {
+	var pids []int32
+	if len(processes) > 0 {
+		var err error
+		pids, err = FindProcessPids(processes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !m.empty() {
+		seen := make(map[int32]bool)
+		for _, pid := range pids {
+			seen[pid] = true
+		}
+		for _, pid := range m.findPids() {
+			if !seen[pid] {
+				pids = append(pids, pid)
+			}
+		}
+		if len(pids) == 0 {
+			return nil, fmt.Errorf("no process matches %s", m)
+		}
+	}
+	if len(pids) == 0 {
+		return nil, errors.New("no target process, use -p, --name, --cgroup or --container-pid-ns")
+	}
+	return pids, nil
+}
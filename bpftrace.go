@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// bpftraceTracer probes with uprobes/uretprobes through bpftrace, it does
+// not need any debuginfo package, arguments are read from registers.
+// bpftrace can not take pids once started, so every Attach runs another
+// bpftrace, the instances share the event numbering.
+type bpftraceTracer struct {
+	mutex       sync.Mutex
+	target      traceTarget
+	commands    []*exec.Cmd
+	scriptPaths []string
+	stopped     bool
+	seq         uint64
+	evc         chan *TraceEvent
+	ec          chan error
+}
+
+type bpftraceAllocProbe struct {
+	Kind     AllocKind
+	Function string
+	Bytes    string
+	OldAddr  string
+	MemPtr   string
+}
+
+type bpftraceFreeProbe struct {
+	Kind     FreeKind
+	Function string
+}
+
+var bpftraceAllocProbes = []bpftraceAllocProbe{
+	{Kind: AllocMalloc, Function: "malloc", Bytes: "arg0"},
+	{Kind: AllocCalloc, Function: "calloc", Bytes: "arg0 * arg1"},
+	{Kind: AllocRealloc, Function: "realloc", Bytes: "arg1", OldAddr: "arg0"},
+	{Kind: AllocPosixMemalign, Function: "posix_memalign", Bytes: "arg2", MemPtr: "arg0"},
+	{Kind: AllocAlignedAlloc, Function: "aligned_alloc", Bytes: "arg1"},
+	{Kind: AllocMemalign, Function: "memalign", Bytes: "arg1"},
+	{Kind: AllocValloc, Function: "valloc", Bytes: "arg0"},
+}
+
+var bpftraceFreeProbes = []bpftraceFreeProbe{
+	{Kind: FreeFree, Function: "free"},
+}
+
+func newBpftraceTracer() Tracer {
+	return &bpftraceTracer{}
+}
+
+func (t *bpftraceTracer) CheckDependency() error {
+	if IsCommandAvailable("bpftrace") == false {
+		return errors.New("require install [bpftrace]")
+	}
+	return nil
+}
+
+func (t *bpftraceTracer) Start(target traceTarget, evc chan *TraceEvent, ec chan error) {
+	t.target = target
+	t.evc = evc
+	t.ec = ec
+	err := t.start(target)
+	if err != nil {
+		sendTraceError(ec, err)
+	}
+}
+
+func (t *bpftraceTracer) Attach(pids []int32) error {
+	return t.start(traceTarget{Pids: pids, FollowChildren: t.target.FollowChildren})
+}
+
+func (t *bpftraceTracer) start(target traceTarget) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.stopped {
+		return errors.New("tracer stopped")
+	}
+
+	pid := target.Pids[0]
+	set, err := newProbeSet(target.Pids)
+	if err != nil {
+		return err
+	}
+
+	scriptPath, err := writeProbeScript("memory-track-*.bt", buildBpftraceScript(target, set))
+	if err != nil {
+		return err
+	}
+	t.scriptPaths = append(t.scriptPaths, scriptPath)
+
+	var command *exec.Cmd
+	if target.single() {
+		command = exec.Command("bpftrace", "-p", strconv.Itoa(int(pid)), scriptPath)
+	} else {
+		command = exec.Command("bpftrace", scriptPath)
+	}
+	if recordSampling() {
+		// @sampled_count is not updated atomically, the map is given room
+		// beyond it
+		command.Env = append(os.Environ(), "BPFTRACE_MAP_KEYS_MAX="+strconv.Itoa(2*SampleMapSize))
+	}
+	outReader, errReader, err := getStdPipeReader(command)
+	if err != nil {
+		return fmt.Errorf("get probe pipe reader: %w", err)
+	}
+
+	err = command.Start()
+	if err != nil {
+		return fmt.Errorf("probe cmd start error: %w", err)
+	}
+	t.commands = append(t.commands, command)
+
+	go checkErrReader(errReader, t.ec)
+	go collectBpftraceEvent(outReader, &t.seq, t.evc, t.ec)
+	return nil
+}
+
+func (t *bpftraceTracer) Stop() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.stopped = true
+	var wg sync.WaitGroup
+	for _, command := range t.commands {
+		wg.Add(1)
+		go func(command *exec.Cmd) {
+			defer wg.Done()
+			stopCommand(command)
+		}(command)
+	}
+	wg.Wait()
+	for _, scriptPath := range t.scriptPaths {
+		_ = os.Remove(scriptPath)
+	}
+}
+
+func buildBpftracePrintStr(format string, args string) string {
+	return buildBpftracePrintAtStr(format, args, "nsecs")
+}
+
+// buildBpftracePrintAtStr prints an event timed earlier, as the release of
+// a realloc.
+func buildBpftracePrintAtStr(format string, args string, time string) string {
+	return "printf(\"" + OpStart + "\\n" + "time=%lld\\n" + "pid=%d\\n" + "tid=%d\\n" + "comm=%s\\n" + format + StackStart + "\\n\", " +
+		time + ", pid, tid, comm, " + args + "); " +
+		"printf(\"%s\", ustack(perf)); " +
+		"printf(\"" + StackEnd + "\\n" + OpEnd + "\\n\\n\"); "
+}
+
+func buildBpftraceAllocProbeStr(lib string, p bpftraceAllocProbe, pred string) string {
+	entry := "@bytes_" + p.Function + "[tid] = " + p.Bytes + "; "
+	bytes := "@bytes_" + p.Function + "[tid]"
+	ret := "retval"
+	if len(p.MemPtr) > 0 {
+		entry += "@memptr_" + p.Function + "[tid] = " + p.MemPtr + "; "
+		ret = "*(uint64 *)uptr(@memptr_" + p.Function + "[tid])"
+	}
+	cond := buildBpftraceAllocPrintStr(p.Kind, bytes, ret)
+	if len(p.MemPtr) > 0 {
+		cond = "if (retval == 0) { " + cond + "} "
+	}
+	cleanup := "delete(@in_" + p.Function + "[tid]); " +
+		"delete(@bytes_" + p.Function + "[tid]); "
+	if len(p.MemPtr) > 0 {
+		cleanup += "delete(@memptr_" + p.Function + "[tid]); "
+	}
+	if len(p.OldAddr) > 0 {
+		entry += buildBpftraceReallocEntryStr(p)
+		cond = buildBpftraceReallocReleaseStr(p, bytes, ret) + cond
+		cleanup += "delete(@oldmem_" + p.Function + "[tid]); " +
+			"delete(@realloc_time[tid]); "
+	}
+	// the return probe fires only after the entry probe, which filters
+	// the --tid threads
+	return "uprobe:" + lib + ":" + p.Function + " /" + pred + buildBpftraceTidPred(p.OldAddr) + "/\n" +
+		"{ @in_" + p.Function + "[tid] = 1; " + entry + "}\n" +
+		"uretprobe:" + lib + ":" + p.Function + " /" + pred + " && @in_" + p.Function + "[tid]/\n" +
+		"{ " + cond + cleanup + "}\n"
+}
+
+func buildBpftraceAllocPrintStr(kind AllocKind, bytes string, ret string) string {
+	if recordSampling() {
+		return buildBpftraceSampledAllocStr(kind, bytes, ret)
+	}
+	return buildBpftracePrintStr("op="+kind.String()+"\\n"+"bytes=%lld\\n"+"return=0x%llx\\n", bytes+", "+ret)
+}
+
+// Same as the stap script, the release of the old block of a realloc is
+// timed on entry, as the block may be given to another thread before
+// realloc returns, and printed on return once realloc succeeded. The
+// allocation half is reported as the other allocations.
+func buildBpftraceReallocEntryStr(p bpftraceAllocProbe) string {
+	old := "@oldmem_" + p.Function + "[tid]"
+	entry := old + " = " + p.OldAddr + "; "
+	if recordSampling() {
+		return entry + "if (@sampled[pid, " + old + "]) { " +
+			"delete(@sampled[pid, " + old + "]); @sampled_count--; " +
+			"@realloc_time[tid] = nsecs; } "
+	}
+	return entry + "if (" + old + " != 0) { @realloc_time[tid] = nsecs; } "
+}
+
+func buildBpftraceReallocReleaseStr(p bpftraceAllocProbe, bytes string, ret string) string {
+	old := "@oldmem_" + p.Function + "[tid]"
+	keep := ""
+	if recordSampling() {
+		keep = "else { @sampled[pid, " + old + "] = 1; @sampled_count++; } "
+	}
+	return "if (@realloc_time[tid]) { " +
+		"if (" + ret + " != 0 || " + bytes + " == 0) { " +
+		buildBpftracePrintAtStr("op="+FreeRealloc.String()+"\\n"+"mem=%lld\\n", old, "@realloc_time[tid]") +
+		"} " +
+		keep +
+		"} "
+}
+
+func buildBpftraceFreeProbeStr(lib string, p bpftraceFreeProbe, pred string) string {
+	return "uprobe:" + lib + ":" + p.Function + " /" + pred + "/\n" +
+		"{ " + buildBpftraceFreePrintStr(p.Kind) + "}\n"
+}
+
+func buildBpftraceFreePrintStr(kind FreeKind) string {
+	if recordSampling() {
+		return buildBpftraceSampledFreeStr(kind, "arg0")
+	}
+	return buildBpftracePrintStr("op="+kind.String()+"\\n"+"mem=%lld\\n", "arg0")
+}
+
+// Same as the stap script, the calls of libc made from inside operator
+// new/delete are skipped and only the outermost operator is reported.
+func buildBpftraceCxxAllocProbeStr(lib string, p allocProbe, pred string) string {
+	return "uprobe:" + lib + ":" + p.Function + " /" + pred + "/\n" +
+		"{ @cxx_alloc_depth[tid]++; @bytes_" + p.Function + "[tid] = arg0; }\n" +
+		"uretprobe:" + lib + ":" + p.Function + " /" + pred + "/\n" +
+		"{ @cxx_alloc_depth[tid]--; " +
+		"if (@cxx_alloc_depth[tid] <= 0) { " +
+		"delete(@cxx_alloc_depth[tid]); " +
+		buildBpftraceCxxAllocPrintStr(p) +
+		"} " +
+		"delete(@bytes_" + p.Function + "[tid]); " +
+		"}\n"
+}
+
+func buildBpftraceCxxAllocPrintStr(p allocProbe) string {
+	return buildBpftraceAllocPrintStr(p.Kind, "@bytes_"+p.Function+"[tid]", "retval")
+}
+
+func buildBpftraceCxxThrowProbeStr(lib string, pred string) string {
+	return "uprobe:" + lib + ":" + cxxThrowFunction + " /" + pred + "/\n" +
+		"{ delete(@cxx_alloc_depth[tid]); }\n"
+}
+
+func buildBpftraceCxxFreeProbeStr(lib string, p freeProbe, pred string) string {
+	return "uprobe:" + lib + ":" + p.Function + " /" + pred + "/\n" +
+		"{ if (@cxx_free_depth[tid] == 0) { " +
+		buildBpftraceFreePrintStr(p.Kind) +
+		"} " +
+		"@cxx_free_depth[tid]++; }\n" +
+		"uretprobe:" + lib + ":" + p.Function + " /" + pred + "/\n" +
+		"{ @cxx_free_depth[tid]--; if (@cxx_free_depth[tid] <= 0) { delete(@cxx_free_depth[tid]); } }\n"
+}
+
+// buildBpftraceTargetStr fills the @targets map without a single target,
+// with the children forked by a target when they are followed, and the
+// @tids map with the --tid threads.
+func buildBpftraceTargetStr(target traceTarget) string {
+	script := "BEGIN\n" +
+		"{ "
+	if !target.single() {
+		for _, pid := range target.Pids {
+			script += "@targets[" + strconv.Itoa(int(pid)) + "] = 1; "
+		}
+	}
+	for _, tid := range RecordTids {
+		script += "@tids[" + strconv.Itoa(int(tid)) + "] = 1; "
+	}
+	script += "}\n"
+	if target.FollowChildren {
+		script += "tracepoint:sched:sched_process_fork /@targets[pid]/\n" +
+			"{ @targets[args->child_pid] = 1; }\n"
+	}
+	script += "END\n" +
+		"{ "
+	if !target.single() {
+		script += "clear(@targets); "
+	}
+	if len(RecordTids) > 0 {
+		script += "clear(@tids); "
+	}
+	return script + "}\n"
+}
+
+// buildBpftraceTidPred is the bpftrace version of stapTidCond, old is
+// empty but for realloc.
+func buildBpftraceTidPred(old string) string {
+	if len(RecordTids) == 0 {
+		return ""
+	}
+	if len(old) > 0 {
+		return " && (@tids[tid] || " + old + " != 0)"
+	}
+	return " && @tids[tid]"
+}
+
+// A single target is attached with -p, else the probes see every process
+// and the pids are checked against the @targets map.
+func buildBpftraceScript(target traceTarget, set *probeSet) string {
+	pred := "pid == " + strconv.Itoa(int(target.Pids[0]))
+	script := ""
+	if !target.single() {
+		pred = "@targets[pid]"
+	}
+	if !target.single() || len(RecordTids) > 0 {
+		script += buildBpftraceTargetStr(target)
+	}
+	script += buildBpftraceProbeSetStr(set, pred)
+	if recordSampling() {
+		script += "END\n" +
+			"{ clear(@sampled); clear(@sampled_count); }\n"
+	}
+	PrintDebugInfo("bpftrace script:\n%s", script)
+	return script
+}
+
+// buildBpftraceProbeSetStr probes each library of the set once, the libc
+// probes skip the calls of operator new/delete when libstdc++ is probed.
+func buildBpftraceProbeSetStr(s *probeSet, pred string) string {
+	script := ""
+	allocPred := pred
+	freePred := pred
+	if len(s.LibStdCpps) > 0 {
+		allocPred += " && @cxx_alloc_depth[tid] == 0"
+		freePred += " && @cxx_free_depth[tid] == 0"
+	}
+	for _, lib := range s.LibStdCpps {
+		for _, p := range filterAllocProbes(lib.Path, cxxAllocProbes) {
+			script += buildBpftraceCxxAllocProbeStr(lib.Path, p, pred+buildBpftraceTidPred(""))
+		}
+		for _, p := range filterFreeProbes(lib.Path, cxxFreeProbes) {
+			script += buildBpftraceCxxFreeProbeStr(lib.Path, p, pred)
+		}
+		if filterProbeFunctions(lib.Path, []string{cxxThrowFunction})[cxxThrowFunction] {
+			script += buildBpftraceCxxThrowProbeStr(lib.Path, pred)
+		}
+	}
+
+	var functions []string
+	for _, p := range bpftraceAllocProbes {
+		functions = append(functions, p.Function)
+	}
+	for _, p := range bpftraceFreeProbes {
+		functions = append(functions, p.Function)
+	}
+	for _, lib := range s.LibCs {
+		available := filterProbeFunctions(lib.Path, functions)
+		for _, p := range bpftraceAllocProbes {
+			if available[p.Function] {
+				script += buildBpftraceAllocProbeStr(lib.Path, p, allocPred)
+			}
+		}
+		for _, p := range bpftraceFreeProbes {
+			if available[p.Function] {
+				script += buildBpftraceFreeProbeStr(lib.Path, p, freePred)
+			}
+		}
+	}
+	return script
+}
+
+// bpftraceReorderWindow is how long the events are held to be ordered by
+// time, bpftrace reads the perf buffers of the CPUs in turn.
+const bpftraceReorderWindow = 200 * time.Millisecond
+
+// bpftrace has no global atomic counter, the events are ordered by their
+// time within bpftraceReorderWindow and then numbered by the collectors on
+// seq. The timestamps are CLOCK_MONOTONIC and converted to wall clock like
+// the stap ones.
+func collectBpftraceEvent(outReader *bufio.Reader, seq *uint64, evc chan *TraceEvent, ec chan error) {
+	timeOffset := bpftraceTimeOffset()
+	events := make(chan *TraceEvent, 1024)
+	go func() {
+		readOperationBlock(outReader, ec, func(opStr []string) {
+			ev, err := parseOpStr(convertBpftraceOpStr(opStr))
+			if err != nil {
+				sendTraceError(ec, fmt.Errorf("parse op str error: %w", err))
+				return
+			}
+			if ev.Malloc != nil {
+				ev.Malloc.Time += timeOffset
+			} else {
+				ev.Free.Time += timeOffset
+			}
+			events <- ev
+		})
+		close(events)
+	}()
+
+	sequencer := newTimeSequencer()
+	number := func(ready []*TraceEvent) {
+		for _, ev := range ready {
+			n := atomic.AddUint64(seq, 1)
+			if ev.Malloc != nil {
+				ev.Malloc.Seq = n
+			} else {
+				ev.Free.Seq = n
+			}
+			sendTraceEvent(evc, ev)
+		}
+	}
+	ticker := time.NewTicker(bpftraceReorderWindow / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				number(sequencer.flush())
+				return
+			}
+			sequencer.push(ev)
+		case <-ticker.C:
+			number(sequencer.pop(time.Now().UnixNano() - int64(bpftraceReorderWindow)))
+		}
+	}
+}
+
+func bpftraceTimeOffset() int64 {
+	var ts unix.Timespec
+	err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts)
+	if err != nil {
+		PrintDebugInfo("get monotonic clock failed: %v", err)
+		return 0
+	}
+	return time.Now().UnixNano() - ts.Nano()
+}
+
+var bpftraceStackLineRegexp = regexp.MustCompile(`^\s*([0-9a-fA-F]+) (\S+) \((.*)\)$`)
+
+// convertBpftraceOpStr rewrites the ustack(perf) frames,
+// e.g. "7f2d1c4b2f6d foo+29 (/usr/lib/libfoo.so)",
+// into the stap backtrace format "0x7f2d1c4b2f6d : foo+0x1d/0x0 [/usr/lib/libfoo.so]".
+func convertBpftraceOpStr(opStr []string) []string {
+	var ret []string
+	isStackRange := false
+	for _, s := range opStr {
+		if s == StackStart {
+			isStackRange = true
+		} else if s == StackEnd {
+			isStackRange = false
+		} else if isStackRange {
+			if len(strings.TrimSpace(s)) == 0 {
+				continue
+			}
+			s = convertBpftraceStackLine(s)
+		}
+		ret = append(ret, s)
+	}
+	return ret
+}
+
+func convertBpftraceStackLine(line string) string {
+	match := bpftraceStackLineRegexp.FindStringSubmatch(line)
+	if match == nil {
+		return strings.TrimSpace(line)
+	}
+	funcName := match[2]
+	offset := int64(0)
+	if index := strings.LastIndex(funcName, "+"); index > 0 {
+		offset, _ = strconv.ParseInt(funcName[index+1:], 10, 64)
+		funcName = funcName[:index]
+	}
+	return fmt.Sprintf("0x%s : %s+0x%x/0x0 [%s]", match[1], funcName, offset, match[3])
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"github.com/gookit/color"
+	"github.com/spf13/cobra"
+	"os"
+	"strings"
+)
+
+var diffCmd = &cobra.Command{
+	Use:   "diff",
+	Short: "Compare memory statistics of two records",
+	Run:   runDiffCmd,
+}
+
+var DiffPathA string
+var DiffPathB string
+var DiffFormat string
+var DiffTop int
+
+func init() {
+	diffCmd.Flags().StringVarP(&DiffPathA, "old", "a", "", "old input file path")
+	diffCmd.Flags().StringVarP(&DiffPathB, "new", "b", "", "new input file path")
+	diffCmd.Flags().StringVar(&DiffFormat, "format", "tui", "output format ("+strings.Join(diffFormatNames, "|")+")")
+	diffCmd.Flags().IntVar(&DiffTop, "top", 10, "entries per ranking in text/json output, 0 for all")
+	_ = diffCmd.MarkFlagRequired("old")
+	_ = diffCmd.MarkFlagRequired("new")
+	rootCmd.AddCommand(diffCmd)
+}
+
+func runDiffCmd(cmd *cobra.Command, args []string) {
+	err := DiffTrack(os.Stdout, DiffPathA, DiffPathB, DiffFormat, DiffTop)
+	if err != nil {
+		color.Error.Prompt("%v", err)
+	}
+}
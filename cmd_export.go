@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"github.com/gookit/color"
+	"github.com/spf13/cobra"
+)
+
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export track data as folded stacks, flame graph or pprof profile",
+	Run:   runExportCmd,
+}
+
+var ExportInputPath string
+var ExportOutPath string
+var ExportValue string
+var ExportFolded bool
+var ExportSvg bool
+var ExportPprof bool
+
+func init() {
+	exportCmd.Flags().StringVarP(&ExportInputPath, "input", "i", "", "input file path")
+	exportCmd.Flags().StringVarP(&ExportOutPath, "output", "o", "", "output file path (default stdout)")
+	exportCmd.Flags().StringVar(&ExportValue, "value", "live", "bytes to export (alloc|live)")
+	exportCmd.Flags().BoolVar(&ExportFolded, "folded", false, "export folded stacks for flamegraph.pl")
+	exportCmd.Flags().BoolVar(&ExportSvg, "svg", false, "export flame graph svg")
+	exportCmd.Flags().BoolVar(&ExportPprof, "pprof", false, "export gzipped pprof profile with alloc and inuse samples")
+	_ = exportCmd.MarkFlagRequired("input")
+	rootCmd.AddCommand(exportCmd)
+}
+
+func runExportCmd(cmd *cobra.Command, args []string) {
+	var format string
+	var count int
+	if ExportFolded {
+		format = "folded"
+		count++
+	}
+	if ExportSvg {
+		format = "svg"
+		count++
+	}
+	if ExportPprof {
+		format = "pprof"
+		count++
+	}
+	if count != 1 {
+		color.Error.Prompt("%v", errors.New("specify one of --folded, --svg or --pprof"))
+		return
+	}
+
+	err := Load(ExportInputPath)
+	if err != nil {
+		color.Error.Prompt("%v", err)
+		return
+	}
+	err = ExportTrack(ExportOutPath, format, ExportValue)
+	if err != nil {
+		color.Error.Prompt("%v", err)
+	}
+}
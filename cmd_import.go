@@ -0,0 +1,39 @@
+package main
+
+import (
+	"github.com/gookit/color"
+	"github.com/spf13/cobra"
+)
+
+var importCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Import raw stap output logs as track data",
+	Run:   runImportCmd,
+}
+
+var ImportMallocLogPath string
+var ImportFreeLogPath string
+var ImportLogPaths []string
+
+func init() {
+	importCmd.Flags().StringVar(&ImportMallocLogPath, "malloc-log", "", "stdout log of the malloc probe")
+	importCmd.Flags().StringVar(&ImportFreeLogPath, "free-log", "", "stdout log of the free probe")
+	importCmd.Flags().StringSliceVar(&ImportLogPaths, "log", nil, "stdout log of the probe script (repeatable)")
+	importCmd.Flags().StringVarP(&RecordOutPath, "output", "o", "", "output file path")
+	rootCmd.AddCommand(importCmd)
+}
+
+func runImportCmd(cmd *cobra.Command, args []string) {
+	var logPaths []string
+	if len(ImportMallocLogPath) > 0 {
+		logPaths = append(logPaths, ImportMallocLogPath)
+	}
+	if len(ImportFreeLogPath) > 0 {
+		logPaths = append(logPaths, ImportFreeLogPath)
+	}
+	logPaths = append(logPaths, ImportLogPaths...)
+	err := ImportStapLog(logPaths)
+	if err != nil {
+		color.Error.Prompt("%v", err)
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"github.com/gookit/color"
+	"github.com/spf13/cobra"
+)
+
+var mergeCmd = &cobra.Command{
+	Use:   "merge -o path input_path...",
+	Short: "Merge several records into one",
+	Run:   runMergeCmd,
+	Args:  cobra.MinimumNArgs(2),
+}
+
+var MergeOutPath string
+
+func init() {
+	mergeCmd.Flags().StringVarP(&MergeOutPath, "output", "o", "", "output file path")
+	_ = mergeCmd.MarkFlagRequired("output")
+	rootCmd.AddCommand(mergeCmd)
+}
+
+func runMergeCmd(cmd *cobra.Command, args []string) {
+	err := MergeTrack(MergeOutPath, args)
+	if err != nil {
+		color.Error.Prompt("%v", err)
+	}
+}
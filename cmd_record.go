@@ -3,6 +3,8 @@ package main
 import (
 	"github.com/gookit/color"
 	"github.com/spf13/cobra"
+	"strings"
+	"time"
 )
 
 var recordCmd = &cobra.Command{
@@ -12,19 +14,55 @@ var recordCmd = &cobra.Command{
 }
 
 var RecordPid int32
+var RecordProcesses []string
+var RecordFollowChildren bool
+var RecordName string
+var RecordCgroup string
+var RecordPidNs string
+var RecordSampleRate int64
+var RecordSampleBytes int64
 var RecordTime int32
 var RecordOutPath string
+var RecordBackend string
+var RecordLive bool
+var RecordSnapshotInterval time.Duration
+var RecordTids []int32
 
 func init() {
-	recordCmd.Flags().Int32VarP(&RecordPid, "pid", "p", 0, "target process id")
-	_ = recordCmd.MarkFlagRequired("pid")
+	recordCmd.Flags().StringSliceVarP(&RecordProcesses, "pid", "p", nil, "target process ids or names")
 	recordCmd.Flags().Int32VarP(&RecordTime, "time", "t", -1, "record seconds")
 	recordCmd.Flags().StringVarP(&RecordOutPath, "output", "o", "", "output file path")
+	recordCmd.Flags().StringVar(&RecordBackend, "backend", "stap", "tracer backend ("+strings.Join(TracerBackendNames(), "|")+")")
+	recordCmd.Flags().BoolVar(&RecordLive, "live", false, "show the report UI while recording, [s] writes a snapshot")
+	recordCmd.Flags().DurationVar(&RecordSnapshotInterval, "snapshot-interval", 0, "write a snapshot of the statistics at this interval, e.g. 10m")
+	recordCmd.Flags().Int32SliceVar(&RecordTids, "tid", nil, "only record the allocations of these thread ids")
+	recordCmd.Flags().BoolVar(&RecordFollowChildren, "follow-children", false, "record the processes forked by the targets as well")
+	recordCmd.Flags().StringVar(&RecordName, "name", "", "record the processes of this name, attaching the ones started while recording")
+	recordCmd.Flags().StringVar(&RecordCgroup, "cgroup", "", "record the processes of this cgroup, e.g. /sys/fs/cgroup/system.slice/nginx.service")
+	recordCmd.Flags().StringVar(&RecordPidNs, "container-pid-ns", "", "record the processes of this pid namespace, as pid:[inode], inode or /proc/pid/ns/pid")
+	recordCmd.Flags().Int64Var(&RecordSampleRate, "sample-rate", 0, "only record one of this many allocations, the statistics are weighted back")
+	recordCmd.Flags().Int64Var(&RecordSampleBytes, "sample-bytes", 0, "only record one allocation every this many bytes on average, the statistics are weighted back")
 	rootCmd.AddCommand(recordCmd)
 }
 
 func runRecordCmd(cmd *cobra.Command, args []string) {
-	err := RecordProcessMem(RecordPid)
+	err := checkRecordSampling()
+	if err != nil {
+		color.Error.Prompt("%v", err)
+		return
+	}
+	matcher, err := newProcessMatcher(RecordName, RecordCgroup, RecordPidNs)
+	if err != nil {
+		color.Error.Prompt("%v", err)
+		return
+	}
+	pids, err := resolveRecordTargets(RecordProcesses, matcher)
+	if err != nil {
+		color.Error.Prompt("%v", err)
+		return
+	}
+	RecordPid = pids[0]
+	err = RecordProcessMem(pids, matcher)
 	if err != nil {
 		color.Error.Prompt("%v", err)
 	}
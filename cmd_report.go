@@ -3,6 +3,9 @@ package main
 import (
 	"github.com/gookit/color"
 	"github.com/spf13/cobra"
+	"os"
+	"strings"
+	"time"
 )
 
 var reportCmd = &cobra.Command{
@@ -14,22 +17,60 @@ var reportCmd = &cobra.Command{
 
 var ReportInputPath string
 var ReportMinByte int64
-var ReportMinCount int32
+var ReportMinCount int64
+var ReportFrom time.Duration
+var ReportTo time.Duration
+var ReportFormat string
+var ReportTop int
+var ReportSnapshot int
+var ReportListSnapshots bool
+var ReportMinSize int64
+var ReportMaxSize int64
+var ReportPid int32
 
 func init() {
 	reportCmd.Flags().StringVarP(&ReportInputPath, "input", "i", "", "input file path")
 	reportCmd.Flags().Int64VarP(&ReportMinByte, "min_byte", "b", 100, "greater than the specified byte is displayed")
-	reportCmd.Flags().Int32VarP(&ReportMinCount, "min_count", "c", 10, "greater than the specified count is displayed")
+	reportCmd.Flags().Int64VarP(&ReportMinCount, "min_count", "c", 10, "greater than the specified count is displayed")
+	reportCmd.Flags().DurationVar(&ReportFrom, "from", 0, "report events after this time since record start, e.g. 5m")
+	reportCmd.Flags().DurationVar(&ReportTo, "to", 0, "report events before this time since record start, e.g. 10m")
+	reportCmd.Flags().StringVar(&ReportFormat, "format", "tui", "output format ("+strings.Join(reportFormatNames, "|")+")")
+	reportCmd.Flags().IntVar(&ReportTop, "top", 10, "entries per ranking in text/json/csv output, 0 for all")
+	reportCmd.Flags().IntVar(&ReportSnapshot, "snapshot", 0, "report the snapshot with this number instead of the record end")
+	reportCmd.Flags().BoolVar(&ReportListSnapshots, "list-snapshots", false, "list the snapshots of the track file")
+	reportCmd.Flags().Int64Var(&ReportMinSize, "min-size", 0, "only count the allocations of at least this size, by power of two size class")
+	reportCmd.Flags().Int64Var(&ReportMaxSize, "max-size", 0, "only count the allocations of at most this size, by power of two size class, 0 for no limit")
+	reportCmd.Flags().Int32Var(&ReportPid, "pid", 0, "report the events of this recorded process, 0 for all")
 	_ = reportCmd.MarkFlagRequired("input")
 	rootCmd.AddCommand(reportCmd)
 }
 
 func runReportCmd(cmd *cobra.Command, args []string) {
-	err := Load(ReportInputPath)
+	err := LoadSnapshot(ReportInputPath, ReportSnapshot)
 	if err != nil {
 		color.Error.Prompt("%v", err)
+		return
+	}
+	if ReportListSnapshots {
+		err = WriteSnapshotList(os.Stdout)
+		if err != nil {
+			color.Error.Prompt("%v", err)
+		}
+		return
+	}
+	warnReportSizeRange()
+	if cmd.Flags().Changed("from") || cmd.Flags().Changed("to") || ReportPid != 0 {
+		err = ReplayTimeRange(ReportFrom, ReportTo, ReportPid)
+		if err != nil {
+			color.Error.Prompt("%v", err)
+			return
+		}
+	}
+	if ReportFormat != "tui" {
+		err = WriteReport(os.Stdout, ReportFormat, ReportTop)
+	} else {
+		err = ShowReportUI()
 	}
-	err = ShowReportUI()
 	if err != nil {
 		color.Error.Prompt("%v", err)
 	}
@@ -9,7 +9,7 @@ import (
 var rootCmd = &cobra.Command{
 	Use:     "memory-track",
 	Short:   "A memory track tool",
-	Example: "memory-track record -p pid [-t sec] [-o path]\nmemory-track report -i path",
+	Example: "memory-track record -p pid|name[,...]|--name name|--cgroup path|--container-pid-ns ns [--follow-children] [-t sec] [-o path] [--live] [--snapshot-interval 10m] [--tid tid,...] [--sample-rate N] [--sample-bytes N]\nmemory-track run [-t sec] [-o path] -- command [args...]\nmemory-track report -i path [--format text|json|csv] [--top N] [--snapshot N|--list-snapshots] [--min-size N] [--max-size N] [--pid N]\nmemory-track diff -a old_path -b new_path [--format text|json] [--top N]\nmemory-track merge -o path input_path...\nmemory-track export -i path --folded|--svg|--pprof [--value alloc|live] [-o path]",
 }
 
 var Verbose bool
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"github.com/gookit/color"
+	"github.com/spf13/cobra"
+)
+
+var runCmd = &cobra.Command{
+	Use:   "run [flags] -- command [args...]",
+	Short: "Run command with a preload shim and record its malloc/free call",
+	Args:  cobra.MinimumNArgs(1),
+	Run:   runRunCmd,
+}
+
+func init() {
+	runCmd.Flags().Int32VarP(&RecordTime, "time", "t", -1, "record seconds")
+	runCmd.Flags().StringVarP(&RecordOutPath, "output", "o", "", "output file path")
+	runCmd.Flags().DurationVar(&RecordSnapshotInterval, "snapshot-interval", 0, "write a snapshot of the statistics at this interval, e.g. 10m")
+	rootCmd.AddCommand(runCmd)
+}
+
+func runRunCmd(cmd *cobra.Command, args []string) {
+	err := RunProcessMem(args)
+	if err != nil {
+		color.Error.Prompt("%v", err)
+	}
+}
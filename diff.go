@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// statValues are the allocated and still live blocks of a stack or file.
+type statValues struct {
+	AllocCount int64 `json:"alloc_count"`
+	AllocBytes int64 `json:"alloc_bytes"`
+	LiveCount  int64 `json:"live_count"`
+	LiveBytes  int64 `json:"live_bytes"`
+}
+
+// diffStack is a call site matched in both files by its symbolized
+// frames, Stack is the one of the newer file when it has the call site.
+type diffStack struct {
+	Stack []string
+	A     statValues
+	B     statValues
+}
+
+type diffEntry struct {
+	Rank  int           `json:"rank"`
+	Delta int64         `json:"delta"`
+	A     statValues    `json:"a"`
+	B     statValues    `json:"b"`
+	Stack []reportFrame `json:"stack"`
+}
+
+type diffRanking struct {
+	Name    string      `json:"name"`
+	Title   string      `json:"title"`
+	Entries []diffEntry `json:"entries"`
+}
+
+type diffOutput struct {
+	SchemaVersion int           `json:"schema_version"`
+	A             reportTrack   `json:"a"`
+	B             reportTrack   `json:"b"`
+	TotalsA       statValues    `json:"totals_a"`
+	TotalsB       statValues    `json:"totals_b"`
+	Rankings      []diffRanking `json:"rankings"`
+}
+
+type diffRankingKind struct {
+	Name      string
+	Title     string
+	ValueName string
+	Value     func(v statValues) int64
+}
+
+var diffRankingKinds = []diffRankingKind{
+	{"live_bytes", "Diff Byte [malloc after free]", "Delta Byte", func(v statValues) int64 { return v.LiveBytes }},
+	{"live_count", "Diff Count [malloc after free]", "Delta Count", func(v statValues) int64 { return v.LiveCount }},
+	{"alloc_bytes", "Diff Byte [malloc]", "Delta Byte", func(v statValues) int64 { return v.AllocBytes }},
+	{"alloc_count", "Diff Count [malloc]", "Delta Count", func(v statValues) int64 { return v.AllocCount }},
+}
+
+var diffFormatNames = []string{"tui", "text", "json"}
+
+// DiffTrack compares the allocations of two track files, old and new,
+// and prints or shows the call sites ranked by their change.
+func DiffTrack(w io.Writer, pathA string, pathB string, format string, top int) error {
+	stacks := make(map[string]*diffStack)
+	output := &diffOutput{SchemaVersion: reportSchemaVersion}
+
+	err := Load(pathA)
+	if err != nil {
+		return fmt.Errorf("load %s: %w", pathA, err)
+	}
+	output.A = newReportTrack(pathA)
+	output.TotalsA = collectDiffValues(stacks, false)
+
+	err = Load(pathB)
+	if err != nil {
+		return fmt.Errorf("load %s: %w", pathB, err)
+	}
+	output.B = newReportTrack(pathB)
+	output.TotalsB = collectDiffValues(stacks, true)
+
+	switch format {
+	case "tui":
+		menuItemSlice = nil
+		for _, kind := range diffRankingKinds {
+			menuItemSlice = append(menuItemSlice, menuItem{kind.Title, kind.ValueName, diffRows(rankDiffStacks(stacks, kind, 0), kind)})
+		}
+		return showMenuUI()
+	case "text", "json":
+		for _, kind := range diffRankingKinds {
+			output.Rankings = append(output.Rankings, buildDiffRanking(rankDiffStacks(stacks, kind, top), kind))
+		}
+		if format == "json" {
+			encoder := json.NewEncoder(w)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(output)
+		}
+		return writeTextDiff(w, output)
+	}
+	return fmt.Errorf("unknown diff format: %s (%s)", format, strings.Join(diffFormatNames, "|"))
+}
+
+// collectDiffValues adds the loaded statistics to the matched stacks, as
+// the newer file when isB is set, and returns the totals of the file.
+func collectDiffValues(stacks map[string]*diffStack, isB bool) statValues {
+	var totals statValues
+	keys := make(map[uint32]string)
+	get := func(id uint32) *statValues {
+		key, ok := keys[id]
+		if !ok {
+			key = diffStackKey(getStack(id))
+			keys[id] = key
+		}
+		s, ok := stacks[key]
+		if !ok {
+			s = &diffStack{Stack: getStack(id)}
+			stacks[key] = s
+		} else if isB {
+			s.Stack = getStack(id)
+		}
+		if isB {
+			return &s.B
+		}
+		return &s.A
+	}
+
+	for id, v := range mallocStatMap {
+		values := get(id)
+		values.AllocCount += v.Count
+		values.AllocBytes += v.Byte
+		totals.AllocCount += v.Count
+		totals.AllocBytes += v.Byte
+	}
+	for _, op := range remainMallocOpMap {
+		values := get(op.StackId)
+		values.LiveCount += op.weight()
+		values.LiveBytes += op.weightedByte()
+		totals.LiveCount += op.weight()
+		totals.LiveBytes += op.weightedByte()
+	}
+	return totals
+}
+
+// diffStackKey identifies a call site across recordings by its functions
+// and module names, without the addresses and offsets which move between
+// runs and builds.
+func diffStackKey(stack []string) string {
+	names := make([]string, 0, len(stack))
+	for _, frame := range stack {
+		_, funcName, moduleName, err := splitStackString(frame)
+		if err != nil {
+			names = append(names, frame)
+			continue
+		}
+		if index := strings.Index(funcName, "+"); index > 0 && !strings.HasPrefix(funcName, "0x") {
+			funcName = funcName[:index]
+		}
+		module := filepath.Base(strings.TrimSuffix(strings.TrimPrefix(moduleName, "["), "]"))
+		names = append(names, funcName+" "+module)
+	}
+	return strings.Join(names, "\n")
+}
+
+// rankDiffStacks sorts the changed stacks by the absolute change of the
+// value, keeping the first top ones unless top is 0.
+func rankDiffStacks(stacks map[string]*diffStack, kind diffRankingKind, top int) []*diffStack {
+	var ranked []*diffStack
+	for _, s := range stacks {
+		if kind.Value(s.B) != kind.Value(s.A) {
+			ranked = append(ranked, s)
+		}
+	}
+	abs := func(x int64) int64 {
+		if x < 0 {
+			return -x
+		}
+		return x
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		di := abs(kind.Value(ranked[i].B) - kind.Value(ranked[i].A))
+		dj := abs(kind.Value(ranked[j].B) - kind.Value(ranked[j].A))
+		if di != dj {
+			return di > dj
+		}
+		return diffStackKey(ranked[i].Stack) < diffStackKey(ranked[j].Stack)
+	})
+	if top > 0 && len(ranked) > top {
+		ranked = ranked[:top]
+	}
+	return ranked
+}
+
+func diffRows(ranked []*diffStack, kind diffRankingKind) []mainRow {
+	var rows []mainRow
+	for _, s := range ranked {
+		delta := kind.Value(s.B) - kind.Value(s.A)
+		rows = append(rows, mainRow{
+			Value: fmt.Sprintf("%+d", delta),
+			Stack: s.Stack,
+			Detail: []string{
+				fmt.Sprintf("a: %d times %d bytes, live %d blocks %d bytes", s.A.AllocCount, s.A.AllocBytes, s.A.LiveCount, s.A.LiveBytes),
+				fmt.Sprintf("b: %d times %d bytes, live %d blocks %d bytes", s.B.AllocCount, s.B.AllocBytes, s.B.LiveCount, s.B.LiveBytes),
+				"",
+			},
+		})
+	}
+	return rows
+}
+
+func buildDiffRanking(ranked []*diffStack, kind diffRankingKind) diffRanking {
+	ranking := diffRanking{Name: kind.Name, Title: kind.Title, Entries: []diffEntry{}}
+	for index, s := range ranked {
+		entry := diffEntry{
+			Rank:  index + 1,
+			Delta: kind.Value(s.B) - kind.Value(s.A),
+			A:     s.A,
+			B:     s.B,
+			Stack: []reportFrame{},
+		}
+		for _, frame := range s.Stack {
+			entry.Stack = append(entry.Stack, buildReportFrame(frame))
+		}
+		ranking.Entries = append(ranking.Entries, entry)
+	}
+	return ranking
+}
+
+func writeTextDiff(w io.Writer, output *diffOutput) error {
+	_, err := fmt.Fprintf(w, "a: %s\nb: %s\n", output.A.Path, output.B.Path)
+	if err != nil {
+		return err
+	}
+	for _, t := range []struct {
+		name   string
+		totals statValues
+	}{{"a", output.TotalsA}, {"b", output.TotalsB}} {
+		_, _ = fmt.Fprintf(w, "%s alloc: %d times %d bytes, live: %d blocks %d bytes\n", t.name,
+			t.totals.AllocCount, t.totals.AllocBytes, t.totals.LiveCount, t.totals.LiveBytes)
+	}
+	for _, ranking := range output.Rankings {
+		_, _ = fmt.Fprintf(w, "\n== %s ==\n", ranking.Title)
+		for _, entry := range ranking.Entries {
+			_, _ = fmt.Fprintf(w, "#%d delta=%+d a=%d/%d b=%d/%d (alloc count/bytes) a=%d/%d b=%d/%d (live count/bytes)\n",
+				entry.Rank, entry.Delta, entry.A.AllocCount, entry.A.AllocBytes, entry.B.AllocCount, entry.B.AllocBytes,
+				entry.A.LiveCount, entry.A.LiveBytes, entry.B.LiveCount, entry.B.LiveBytes)
+			for index, frame := range entry.Stack {
+				_, _ = fmt.Fprintf(w, "    [%d] %s\n", index, frame)
+			}
+		}
+	}
+	return nil
+}
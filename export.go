@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gookit/color"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ExportTrack writes the loaded track data in the format to the path, or
+// to stdout when the path is empty.
+func ExportTrack(outPath string, format string, value string) error {
+	var w io.Writer = os.Stdout
+	if len(outPath) > 0 {
+		file, err := os.Create(outPath)
+		if err != nil {
+			return fmt.Errorf("create export file error: %w", err)
+		}
+		defer file.Close()
+		w = file
+	}
+
+	err := writeExport(w, format, value)
+	if err != nil {
+		return err
+	}
+	if len(outPath) > 0 {
+		color.Info.Prompt("export %s to [%s]", format, outPath)
+	}
+	return nil
+}
+
+func writeExport(w io.Writer, format string, value string) error {
+	if format == "pprof" {
+		return WritePprof(w)
+	}
+	folded, err := buildFoldedStacks(value)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case "folded":
+		return WriteFolded(w, folded)
+	case "svg":
+		title := fmt.Sprintf("memory-track %s", exportValueNames[value])
+		if len(loadTrackHeader.Exe) > 0 {
+			title = fmt.Sprintf("%s of %s", title, filepath.Base(loadTrackHeader.Exe))
+		}
+		return WriteFlameGraphSVG(w, folded, title)
+	}
+	return fmt.Errorf("unknown export format: %s", format)
+}
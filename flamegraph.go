@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"io"
+	"sort"
+	"strings"
+)
+
+const (
+	FlameGraphWidth       = 1200
+	FlameGraphFrameHeight = 16
+	FlameGraphPadding     = 10
+	FlameGraphTitleHeight = 40
+	FlameGraphFontSize    = 12
+	FlameGraphFontWidth   = 0.59
+)
+
+var exportValueNames = map[string]string{
+	"alloc": "bytes allocated",
+	"live":  "bytes still live",
+}
+
+// buildFoldedStacks sums the bytes by folded stack, the frames of a folded
+// stack are separated by semicolons from the root down to the allocation.
+func buildFoldedStacks(value string) (map[string]int64, error) {
+	byStack := make(map[uint32]int64)
+	switch value {
+	case "alloc":
+		for id, v := range mallocStatMap {
+			byStack[id] += v.Byte
+		}
+	case "live":
+		for _, op := range remainMallocOpMap {
+			byStack[op.StackId] += op.weightedByte()
+		}
+	default:
+		return nil, fmt.Errorf("unknown export value: %s (alloc|live)", value)
+	}
+
+	folded := make(map[string]int64)
+	for id, bytes := range byStack {
+		if bytes <= 0 {
+			continue
+		}
+		folded[foldStack(getStack(id))] += bytes
+	}
+	return folded, nil
+}
+
+func foldStack(stack []string) string {
+	names := make([]string, 0, len(stack))
+	for i := len(stack) - 1; i >= 0; i-- {
+		names = append(names, foldedFrameName(stack[i]))
+	}
+	if len(names) == 0 {
+		return "[unknown]"
+	}
+	return strings.Join(names, ";")
+}
+
+// foldedFrameName is the demangled function, with its module when the
+// symbol is not resolved.
+func foldedFrameName(rawStack string) string {
+	frame := buildReportFrame(rawStack)
+	name := frame.Function
+	if strings.HasPrefix(name, "0x") && len(frame.Module) > 0 {
+		name = fmt.Sprintf("%s [%s]", name, frame.Module)
+	}
+	return strings.ReplaceAll(name, ";", ":")
+}
+
+// WriteFolded writes the stacks in the flamegraph.pl input format.
+func WriteFolded(w io.Writer, folded map[string]int64) error {
+	keys := make([]string, 0, len(folded))
+	for k := range folded {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	writer := bufio.NewWriter(w)
+	for _, k := range keys {
+		_, _ = fmt.Fprintf(writer, "%s %d\n", k, folded[k])
+	}
+	return writer.Flush()
+}
+
+type flameNode struct {
+	Name     string
+	Value    int64
+	Children map[string]*flameNode
+}
+
+func newFlameNode(name string) *flameNode {
+	return &flameNode{Name: name, Children: make(map[string]*flameNode)}
+}
+
+func (n *flameNode) depth() int {
+	depth := 0
+	for _, child := range n.Children {
+		if d := child.depth() + 1; d > depth {
+			depth = d
+		}
+	}
+	return depth
+}
+
+func (n *flameNode) sortedChildren() []*flameNode {
+	children := make([]*flameNode, 0, len(n.Children))
+	for _, child := range n.Children {
+		children = append(children, child)
+	}
+	sort.Slice(children, func(i, j int) bool {
+		return children[i].Name < children[j].Name
+	})
+	return children
+}
+
+// WriteFlameGraphSVG renders the folded stacks as a flame graph, the root
+// at the bottom and the widths proportional to the bytes.
+func WriteFlameGraphSVG(w io.Writer, folded map[string]int64, title string) error {
+	root := newFlameNode("all")
+	for stack, value := range folded {
+		node := root
+		node.Value += value
+		for _, name := range strings.Split(stack, ";") {
+			child, ok := node.Children[name]
+			if !ok {
+				child = newFlameNode(name)
+				node.Children[name] = child
+			}
+			child.Value += value
+			node = child
+		}
+	}
+
+	depth := root.depth()
+	height := FlameGraphTitleHeight + (depth+1)*FlameGraphFrameHeight + 2*FlameGraphPadding
+	writer := bufio.NewWriter(w)
+	_, _ = fmt.Fprintf(writer, `<?xml version="1.0" standalone="no"?>
+<svg version="1.1" width="%d" height="%d" viewBox="0 0 %d %d" xmlns="http://www.w3.org/2000/svg">
+<rect x="0" y="0" width="100%%" height="100%%" fill="#f8f8f8"/>
+<text x="%d" y="24" font-size="17" font-family="Verdana" text-anchor="middle">%s</text>
+`, FlameGraphWidth, height, FlameGraphWidth, height, FlameGraphWidth/2, html.EscapeString(title))
+
+	if root.Value > 0 {
+		scale := float64(FlameGraphWidth-2*FlameGraphPadding) / float64(root.Value)
+		bottom := height - FlameGraphPadding - FlameGraphFrameHeight
+		writeFlameNode(writer, root, root.Value, FlameGraphPadding, bottom, scale)
+	}
+	_, _ = fmt.Fprintln(writer, "</svg>")
+	return writer.Flush()
+}
+
+func writeFlameNode(w io.Writer, node *flameNode, total int64, x float64, y int, scale float64) {
+	width := float64(node.Value) * scale
+	if width < 0.1 {
+		return
+	}
+	info := fmt.Sprintf("%s (%d bytes, %.2f%%)", node.Name, node.Value, float64(node.Value)*100/float64(total))
+	_, _ = fmt.Fprintf(w, "<g><title>%s</title><rect x=\"%.1f\" y=\"%d\" width=\"%.1f\" height=\"%d\" fill=\"%s\" rx=\"2\"/>",
+		html.EscapeString(info), x, y, width, FlameGraphFrameHeight-1, flameColor(node.Name))
+	chars := int(width / (FlameGraphFontSize * FlameGraphFontWidth))
+	if chars >= 3 {
+		label := node.Name
+		if len(label) > chars {
+			label = label[:chars-2] + ".."
+		}
+		_, _ = fmt.Fprintf(w, "<text x=\"%.1f\" y=\"%d\" font-size=\"%d\" font-family=\"Verdana\">%s</text>",
+			x+3, y+FlameGraphFrameHeight-4, FlameGraphFontSize, html.EscapeString(label))
+	}
+	_, _ = fmt.Fprintln(w, "</g>")
+
+	for _, child := range node.sortedChildren() {
+		writeFlameNode(w, child, total, x, y-FlameGraphFrameHeight, scale)
+		x += float64(child.Value) * scale
+	}
+}
+
+// flameColor picks a warm color from the name, so a function keeps its
+// color across graphs.
+func flameColor(name string) string {
+	hash := hashStackFrames([]string{name})
+	r := 205 + hash%50
+	g := (hash >> 8) % 230
+	b := (hash >> 16) % 55
+	return fmt.Sprintf("rgb(%d,%d,%d)", r, g, b)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/gookit/color"
+	"os"
+	"sort"
+)
+
+// ImportStapLog replays raw probe output captured elsewhere, e.g. the
+// stdout of the stap malloc/free scripts, and saves it as track data.
+func ImportStapLog(logPaths []string) error {
+	if len(logPaths) == 0 {
+		return errors.New("no log to import")
+	}
+
+	var events []*TraceEvent
+	for _, path := range logPaths {
+		logEvents, err := readStapLog(path)
+		if err != nil {
+			return err
+		}
+		PrintVerboseInfo("read %d events from [%s]", len(logEvents), path)
+		events = append(events, logEvents...)
+	}
+	sortImportEvents(events)
+
+	_, err := StartSave("import", "")
+	if err != nil {
+		return err
+	}
+	for _, e := range events {
+		recordEvent(e)
+	}
+
+	savePath, err := Save()
+	if err != nil {
+		return err
+	}
+	color.Info.Prompt("save data to [%s]", savePath)
+	return nil
+}
+
+func readStapLog(path string) ([]*TraceEvent, error) {
+	logFile, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open log error: %w", err)
+	}
+	defer logFile.Close()
+
+	ec := make(chan error, 100)
+	done := make(chan bool)
+	go func() {
+		for err := range ec {
+			color.Warn.Prompt("[%s] %v", path, err)
+		}
+		done <- true
+	}()
+
+	var events []*TraceEvent
+	err = readFileOperationBlock(bufio.NewReader(logFile), func(opStr []string) {
+		ev, err := parseOpStr(opStr)
+		if err != nil {
+			ec <- fmt.Errorf("parse op str error: %w", err)
+		} else {
+			events = append(events, ev)
+		}
+	})
+	close(ec)
+	<-done
+	if err != nil {
+		return nil, fmt.Errorf("read log [%s] error: %w", path, err)
+	}
+	return events, nil
+}
+
+// sortImportEvents restores the order of the events of several logs by
+// sequence number, or by timestamp for logs without it. Logs of the old
+// separate malloc/free scripts have neither, they are applied in the
+// given order, so addresses reused during the record may be miscounted.
+func sortImportEvents(events []*TraceEvent) {
+	hasSeq := true
+	hasTime := true
+	for _, e := range events {
+		if e.Seq() == 0 {
+			hasSeq = false
+		}
+		if e.Time() == 0 {
+			hasTime = false
+		}
+	}
+	if hasSeq {
+		sort.SliceStable(events, func(i, j int) bool {
+			return events[i].Seq() < events[j].Seq()
+		})
+	} else if hasTime {
+		sort.SliceStable(events, func(i, j int) bool {
+			return events[i].Time() < events[j].Time()
+		})
+	} else {
+		color.Warn.Prompt("log has no sequence number nor timestamp, events are applied in file order")
+	}
+}
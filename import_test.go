@@ -0,0 +1,249 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+var (
+	stackAllocA = []string{
+		" 0x7f0000001000 : malloc+0x0/0x100 [/usr/lib64/libc.so.6]",
+		" 0x400100 : alloc_a+0x10/0x40 [/usr/bin/app]",
+	}
+	stackAllocB = []string{
+		" 0x7f0000001000 : malloc+0x0/0x100 [/usr/lib64/libc.so.6]",
+		" 0x400200 : alloc_b+0x10/0x40 [/usr/bin/app]",
+	}
+	stackRelease = []string{
+		" 0x7f0000002000 : free+0x0/0x80 [/usr/lib64/libc.so.6]",
+		" 0x400300 : release+0x10/0x40 [/usr/bin/app]",
+	}
+	stackGrow = []string{
+		" 0x7f0000003000 : realloc+0x0/0x200 [/usr/lib64/libc.so.6]",
+		" 0x400400 : grow+0x10/0x40 [/usr/bin/app]",
+	}
+)
+
+func opBlock(headers []string, stack []string) []string {
+	block := append([]string{}, headers...)
+	block = append(block, StackStart)
+	block = append(block, stack...)
+	return append(block, StackEnd)
+}
+
+// importTestLogs imports the logs of testdata into a track file of the test
+// directory, the stats are left in the global maps.
+func importTestLogs(t *testing.T, names ...string) {
+	t.Helper()
+	resetMemStat()
+	t.Cleanup(resetMemStat)
+	outPath := RecordOutPath
+	RecordOutPath = filepath.Join(t.TempDir(), "import.track")
+	t.Cleanup(func() { RecordOutPath = outPath })
+
+	var paths []string
+	for _, name := range names {
+		paths = append(paths, filepath.Join("testdata", name))
+	}
+	if err := ImportStapLog(paths); err != nil {
+		t.Fatalf("import %v: %v", names, err)
+	}
+}
+
+func checkMallocStat(t *testing.T, stack []string, kind AllocKind, count int64, bytes int64) {
+	t.Helper()
+	id := internStack(stack)
+	s, ok := mallocStatMap[id]
+	if !ok {
+		t.Fatalf("no malloc stat for stack %d", id)
+	}
+	if s.Kind != kind || s.Count != count || s.Byte != bytes {
+		t.Errorf("malloc stat of stack %d = %s %d/%d, want %s %d/%d", id, s.Kind, s.Count, s.Byte, kind, count, bytes)
+	}
+}
+
+func checkRemain(t *testing.T, want map[opKey]uint64) {
+	t.Helper()
+	if len(remainMallocOpMap) != len(want) {
+		t.Errorf("remain %d blocks, want %d", len(remainMallocOpMap), len(want))
+	}
+	for key, seq := range want {
+		m, ok := remainMallocOpMap[key]
+		if !ok {
+			t.Errorf("block %+v not remaining", key)
+			continue
+		}
+		if m.Seq != seq {
+			t.Errorf("block %+v remains from seq %d, want %d", key, m.Seq, seq)
+		}
+	}
+}
+
+func TestParseMallocOpStr(t *testing.T) {
+	op, err := parseMallocOpStr(opBlock([]string{
+		"seq=7", "time=1234", "pid=10", "tid=11", "comm=app",
+		"op=realloc", "bytes=64", "return=0x3000", "oldmem=0x2000",
+	}, stackGrow))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := MallocOp{Seq: 7, Time: 1234, Pid: 10, Tid: 11, Kind: AllocRealloc, Byte: 64,
+		Addr: 0x3000, OldAddr: 0x2000, StackId: internStack(stackGrow)}
+	if *op != want {
+		t.Errorf("parsed %+v, want %+v", *op, want)
+	}
+
+	for _, headers := range [][]string{
+		{"seq=1", "no value"},
+		{"seq=1", "op=mmap"},
+		{"seq=1", "bytes=eight"},
+		{"seq=1", "return=0xzz"},
+		{"pid=big"},
+	} {
+		if _, err := parseMallocOpStr(opBlock(headers, stackAllocA)); err == nil {
+			t.Errorf("headers %v parsed", headers)
+		}
+	}
+	if _, err := parseMallocOpStr([]string{"seq=1", "bytes=8"}); err == nil {
+		t.Error("block without stack parsed")
+	}
+	if _, err := parseMallocOpStr([]string{"seq=1", "bytes=8", StackStart}); err == nil {
+		t.Error("block ending at the stack start parsed")
+	}
+	if _, err := parseMallocOpStr(opBlock([]string{"seq=1", "bytes=8"}, stackAllocA)[:5]); err == nil {
+		t.Error("block without stack end parsed")
+	}
+}
+
+func TestParseFreeOpStr(t *testing.T) {
+	op, err := parseFreeOpStr(opBlock([]string{
+		"seq=8", "time=2345", "pid=10", "tid=12", "op=delete", "mem=4096",
+	}, stackRelease))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := FreeOp{Seq: 8, Time: 2345, Pid: 10, Tid: 12, Kind: FreeDelete, Addr: 4096,
+		StackId: internStack(stackRelease)}
+	if *op != want {
+		t.Errorf("parsed %+v, want %+v", *op, want)
+	}
+
+	if _, err := parseFreeOpStr(opBlock([]string{"op=new"}, stackRelease)); err == nil {
+		t.Error("free op named new parsed")
+	}
+	if _, err := parseFreeOpStr(opBlock([]string{"mem=0x1000"}, stackRelease)); err == nil {
+		t.Error("hex mem parsed")
+	}
+	if _, err := parseFreeOpStr([]string{"mem=4096"}); err == nil {
+		t.Error("block without stack parsed")
+	}
+	if _, err := parseFreeOpStr([]string{"mem=4096", StackStart}); err == nil {
+		t.Error("block ending at the stack start parsed")
+	}
+	if _, err := parseFreeOpStr(opBlock([]string{"mem=4096"}, stackRelease)[:3]); err == nil {
+		t.Error("block without stack end parsed")
+	}
+}
+
+func TestParseOpStr(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers []string
+		free    bool
+		kind    string
+	}{
+		{"old malloc", []string{"seq=1", "comm=app", "bytes=8", "return=0x10"}, false, "malloc"},
+		{"old free", []string{"seq=2", "comm=app", "mem=16"}, true, "free"},
+		{"calloc", []string{"op=calloc", "bytes=8", "return=0x10"}, false, "calloc"},
+		{"delete", []string{"op=delete", "mem=16"}, true, "delete"},
+		{"realloc", []string{"op=realloc", "bytes=8", "return=0x20", "oldmem=0x10"}, false, "realloc"},
+		{"realloc release", []string{"op=realloc", "mem=16"}, true, "realloc"},
+	}
+	for _, tt := range tests {
+		ev, err := parseOpStr(opBlock(tt.headers, stackAllocA))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if (ev.Free != nil) != tt.free || (ev.Malloc != nil) == tt.free {
+			t.Errorf("%s: parsed malloc %v free %v", tt.name, ev.Malloc != nil, ev.Free != nil)
+			continue
+		}
+		kind := ""
+		if tt.free {
+			kind = ev.Free.Kind.String()
+		} else {
+			kind = ev.Malloc.Kind.String()
+		}
+		if kind != tt.kind {
+			t.Errorf("%s: parsed kind %s, want %s", tt.name, kind, tt.kind)
+		}
+		if tt.name == "old malloc" && ev.Comm != "app" {
+			t.Errorf("%s: parsed comm %q", tt.name, ev.Comm)
+		}
+	}
+}
+
+// The blocks of the malloc and free logs interleave by seq: the block freed
+// at seq 2 is allocated again at seq 3, applied in file order it would be
+// freed last.
+func TestImportStapLogOrder(t *testing.T) {
+	importTestLogs(t, "stap_malloc.log", "stap_free.log")
+
+	if len(mallocStatMap) != 2 {
+		t.Errorf("%d malloc stacks, want 2", len(mallocStatMap))
+	}
+	checkMallocStat(t, stackAllocA, AllocMalloc, 2, 48)
+	checkMallocStat(t, stackAllocB, AllocMalloc, 1, 24)
+	if s := freeStatMap[internStack(stackRelease)]; s == nil || s.Count != 2 {
+		t.Errorf("free stat %+v, want 2 releases", s)
+	}
+	checkRemain(t, map[opKey]uint64{{Pid: 100, Addr: 0x1000}: 3})
+	if name := threadNameMap[101]; name != "worker" {
+		t.Errorf("thread 101 named %q, want worker", name)
+	}
+}
+
+// realloc frees its old block when it succeeds, both in the one block of
+// the probes and in the release and allocation halves of the preload
+// library, and keeps it when it fails.
+func TestImportStapLogRealloc(t *testing.T) {
+	importTestLogs(t, "stap_realloc.log")
+
+	checkMallocStat(t, stackAllocA, AllocMalloc, 1, 32)
+	checkMallocStat(t, stackGrow, AllocRealloc, 2, 192)
+	if s := freeStatMap[internStack(stackGrow)]; s == nil || s.Kind != FreeRealloc || s.Count != 2 {
+		t.Errorf("free stat %+v, want 2 realloc releases", s)
+	}
+	checkRemain(t, map[opKey]uint64{{Pid: 200, Addr: 0x4000}: 4})
+}
+
+// Malformed blocks are skipped with a warning, as is a block cut by the end
+// of the log, and the blocks after them are read.
+func TestImportStapLogMalformed(t *testing.T) {
+	events, err := readStapLog(filepath.Join("testdata", "stap_malformed.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].Malloc == nil || events[0].Malloc.Addr != 0x5000 ||
+		events[1].Free == nil || events[1].Free.Addr != 0x5000 {
+		t.Fatalf("read %d events, want the malloc and free of 0x5000 only", len(events))
+	}
+
+	importTestLogs(t, "stap_malformed.log")
+	checkRemain(t, map[opKey]uint64{})
+	checkMallocStat(t, []string{" 0x400100 : alloc_a+0x10/0x40 [/usr/bin/app]"}, AllocMalloc, 1, 8)
+}
+
+func TestImportStapLogMissing(t *testing.T) {
+	if err := ImportStapLog(nil); err == nil {
+		t.Error("import of no log succeeded")
+	}
+	if err := ImportStapLog([]string{filepath.Join("testdata", "missing.log")}); err == nil {
+		t.Error("import of a missing log succeeded")
+	}
+	// a directory opens but fails to read
+	if err := ImportStapLog([]string{"testdata"}); err == nil {
+		t.Error("import of a directory succeeded")
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Weights of the leak suspect score, which adds up to 100.
+const (
+	LeakGrowthWeight = 40
+	LeakRatioWeight  = 30
+	LeakNoFreeWeight = 20
+	LeakAgeWeight    = 10
+
+	// LeakGrowthParts splits the record to tell steady growth from blocks
+	// allocated once, as caches are.
+	LeakGrowthParts = 4
+)
+
+// leakSuspect scores a stack with live blocks by how much they look like
+// a leak rather than a long-lived cache or blocks freed soon after the
+// record stops.
+type leakSuspect struct {
+	StackId uint32
+	Score   int
+	Reasons []string
+}
+
+// rankLeakSuspects scores the stacks of the live slice from the alloc
+// times of their live blocks and sorts them by score.
+func rankLeakSuspects(live []MallocStat) []leakSuspect {
+	stackIds := make(map[uint32]bool)
+	for _, v := range live {
+		stackIds[v.StackId] = true
+	}
+	blocks := make(map[uint32][]*MallocOp)
+	from, to := timelineWindow()
+	for _, op := range remainMallocOpMap {
+		if !stackIds[op.StackId] {
+			continue
+		}
+		blocks[op.StackId] = append(blocks[op.StackId], op)
+		if op.Time > 0 && (from == 0 || op.Time < from) {
+			from = op.Time
+		}
+		if op.Time > to {
+			to = op.Time
+		}
+	}
+	if len(trackSnapshots) > 0 && trackSnapshots[len(trackSnapshots)-1].Time > to {
+		to = trackSnapshots[len(trackSnapshots)-1].Time
+	}
+	window := to - from
+	if window <= 0 {
+		window = 1
+	}
+
+	var suspects []leakSuspect
+	for _, v := range live {
+		ops := blocks[v.StackId]
+		if len(ops) == 0 {
+			continue
+		}
+		var allocCount int64
+		if s, ok := mallocStatMap[v.StackId]; ok {
+			allocCount = s.Count
+		}
+		suspects = append(suspects, scoreLeakSuspect(v, allocCount, ops, from, window))
+	}
+	sort.SliceStable(suspects, func(i, j int) bool {
+		return suspects[i].Score > suspects[j].Score
+	})
+	return suspects
+}
+
+func scoreLeakSuspect(v MallocStat, allocCount int64, ops []*MallocOp, from int64, window int64) leakSuspect {
+	suspect := leakSuspect{StackId: v.StackId}
+	to := from + window
+
+	var parts [LeakGrowthParts]bool
+	first := to
+	var ageSum float64
+	for _, op := range ops {
+		if op.Time < first {
+			first = op.Time
+		}
+		part := int((op.Time - from) * LeakGrowthParts / window)
+		if part < 0 {
+			part = 0
+		} else if part >= LeakGrowthParts {
+			part = LeakGrowthParts - 1
+		}
+		parts[part] = true
+		ageSum += float64(to - op.Time)
+	}
+	spread := 0
+	for _, used := range parts {
+		if used {
+			spread++
+		}
+	}
+	growth := float64(spread) / LeakGrowthParts
+	if spread > 1 {
+		seconds := float64(to-first) / float64(time.Second)
+		slope := float64(v.Byte)
+		if seconds > 0 {
+			slope /= seconds
+		}
+		suspect.Reasons = append(suspect.Reasons, fmt.Sprintf("live blocks allocated in %d of %d parts of the record, +%s/s",
+			spread, LeakGrowthParts, formatByteSize(int64(slope))))
+	} else {
+		suspect.Reasons = append(suspect.Reasons, "live blocks allocated in one burst, as a cache would be")
+	}
+
+	ratio := 1.0
+	if allocCount > v.Count {
+		ratio = float64(v.Count) / float64(allocCount)
+	}
+	suspect.Reasons = append(suspect.Reasons, fmt.Sprintf("%d of %d allocated blocks still live (%.0f%%)", v.Count, allocCount, ratio*100))
+
+	noFree := allocCount <= v.Count
+	if noFree {
+		suspect.Reasons = append(suspect.Reasons, "no block of this stack was freed")
+	}
+
+	age := ageSum / float64(len(ops)) / float64(window)
+	suspect.Reasons = append(suspect.Reasons, fmt.Sprintf("mean age %v of the %v record",
+		time.Duration(ageSum/float64(len(ops))).Round(time.Millisecond), time.Duration(window).Round(time.Millisecond)))
+
+	score := growth*LeakGrowthWeight + ratio*LeakRatioWeight + age*LeakAgeWeight
+	if noFree {
+		score += LeakNoFreeWeight
+	}
+	suspect.Score = int(score + 0.5)
+	return suspect
+}
+
+func leakSuspectRows(suspects []leakSuspect) []mainRow {
+	var rows []mainRow
+	for _, s := range suspects {
+		detail := []string{"Reasons:"}
+		for _, reason := range s.Reasons {
+			detail = append(detail, "  - "+reason)
+		}
+		detail = append(detail, "")
+		rows = append(rows, mainRow{
+			Value:   fmt.Sprintf("%d", s.Score),
+			Stack:   getStack(s.StackId),
+			StackId: s.StackId,
+			Detail:  detail,
+		})
+	}
+	return rows
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// LifetimeBuckets is the size of the lifetime histograms, bucket 0
+	// holds the lifetimes under 1us and bucket i those under 2^i us, the
+	// last one everything longer.
+	LifetimeBuckets = 36
+
+	// ShortLifetime is the lifetime under which a freed block counts as
+	// churn.
+	ShortLifetime = time.Millisecond
+
+	LifetimeBarWidth = 20
+)
+
+// LifetimeStat is the lifetime histogram of the freed blocks of a malloc
+// stack. Total is the sum of the weighted lifetimes in nanoseconds, it
+// stays at math.MaxInt64 rather than overflowing.
+type LifetimeStat struct {
+	Count   int64
+	Total   int64
+	Short   int64
+	Buckets [LifetimeBuckets]int64
+	StackId uint32
+}
+
+func addLifetime(m *MallocOp, f *FreeOp) {
+	if m.Time == 0 || f.Time < m.Time {
+		return
+	}
+	lifetime := f.Time - m.Time
+	s, ok := lifetimeStatMap[m.StackId]
+	if !ok {
+		s = &LifetimeStat{StackId: m.StackId}
+		lifetimeStatMap[m.StackId] = s
+	}
+	weight := m.weight()
+	s.Count += weight
+	s.Total = addLifetimeTotal(s.Total, lifetime, weight)
+	if lifetime < int64(ShortLifetime) {
+		s.Short += weight
+	}
+	s.Buckets[lifetimeBucket(lifetime)] += weight
+}
+
+// addLifetimeTotal adds lifetime times weight to total, saturated as long
+// lived blocks of high sampling weights overflow int64.
+func addLifetimeTotal(total int64, lifetime int64, weight int64) int64 {
+	if weight > 0 && lifetime > (math.MaxInt64-total)/weight {
+		return math.MaxInt64
+	}
+	return total + lifetime*weight
+}
+
+func lifetimeBucket(lifetime int64) int {
+	us := uint64(lifetime / int64(time.Microsecond))
+	bucket := bits.Len64(us)
+	if bucket >= LifetimeBuckets {
+		bucket = LifetimeBuckets - 1
+	}
+	return bucket
+}
+
+// lifetimeBucketLabel is the upper bound of the bucket, rounded.
+func lifetimeBucketLabel(bucket int) string {
+	if bucket == LifetimeBuckets-1 {
+		return ">=" + roundLifetime(time.Duration(int64(1)<<(bucket-1)*int64(time.Microsecond)))
+	}
+	return "<" + roundLifetime(time.Duration(int64(1)<<bucket*int64(time.Microsecond)))
+}
+
+func roundLifetime(d time.Duration) string {
+	switch {
+	case d < time.Millisecond:
+		return d.String()
+	case d < time.Second:
+		return d.Round(time.Millisecond).String()
+	case d < time.Minute:
+		return d.Round(100 * time.Millisecond).String()
+	}
+	return d.Round(time.Second).String()
+}
+
+// lifetimeDetail draws the lifetime histogram of the malloc stack.
+func lifetimeDetail(stackId uint32) []string {
+	s, ok := lifetimeStatMap[stackId]
+	if !ok || s.Count == 0 {
+		return nil
+	}
+	first, last := -1, 0
+	var max int64
+	for i, count := range s.Buckets {
+		if count == 0 {
+			continue
+		}
+		if first < 0 {
+			first = i
+		}
+		last = i
+		if count > max {
+			max = count
+		}
+	}
+	mean := roundLifetime(time.Duration(s.Total / s.Count))
+	if s.Total == math.MaxInt64 {
+		mean = ">" + mean
+	}
+	detail := []string{fmt.Sprintf("Lifetime: %d freed, mean %s, %d under %v", s.Count, mean, s.Short, ShortLifetime)}
+	for i := first; i <= last; i++ {
+		bar := strings.Repeat("#", int((s.Buckets[i]*LifetimeBarWidth+max-1)/max))
+		detail = append(detail, fmt.Sprintf("  %10s %-*s %d", lifetimeBucketLabel(i), LifetimeBarWidth, bar, s.Buckets[i]))
+	}
+	return append(detail, "")
+}
+
+// churnRows ranks the malloc stacks by their blocks freed within
+// ShortLifetime.
+func churnRows() []mainRow {
+	var slice []*LifetimeStat
+	for _, v := range lifetimeStatMap {
+		if v.Short >= ReportMinCount {
+			slice = append(slice, v)
+		}
+	}
+	sort.Slice(slice, func(i, j int) bool {
+		if slice[i].Short != slice[j].Short {
+			return slice[i].Short > slice[j].Short
+		}
+		return slice[i].StackId < slice[j].StackId
+	})
+	var rows []mainRow
+	for _, v := range slice {
+		rows = append(rows, mainRow{
+			Value:   fmt.Sprintf("%d", v.Short),
+			Stack:   getStack(v.StackId),
+			StackId: v.StackId,
+			Detail:  lifetimeDetail(v.StackId),
+		})
+	}
+	return rows
+}
@@ -5,84 +5,430 @@ import (
 	"errors"
 	"fmt"
 	"github.com/gookit/color"
+	"io"
+	"os"
 	"os/exec"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// TracerStopTimeout bounds the wait for a tracer to exit once interrupted.
+const TracerStopTimeout = 10 * time.Second
+
 var stopRecord = make(chan bool, 1)
+
+// recordStopped is closed once the recorder stopped applying the events,
+// the collectors then drop what they still read rather than block on
+// channels no one reads anymore.
+var recordStopped chan struct{}
 var mallocStatMap = make(map[uint32]*MallocStat)
 var freeStatMap = make(map[uint32]*FreeStat)
-var remainMallocOpMap = make(map[uintptr]*MallocOp)
+var remainMallocOpMap = make(map[opKey]*MallocOp)
+var mismatchStatMap = make(map[uint64]*MismatchStat)
+
+// sourceMallocStatMap splits the MallocStat of a stack by source in merged
+// track files.
+var sourceMallocStatMap = make(map[uint32][]*SourceMallocStat)
+
+// lifetimeStatMap counts the freed blocks of each malloc stack by how long
+// they lived.
+var lifetimeStatMap = make(map[uint32]*LifetimeStat)
+
+// sizeStatMap keeps the size histogram of the blocks of each malloc stack.
+var sizeStatMap = make(map[uint32]*SizeStat)
+
+// threadMallocStatMap splits the MallocStat of a stack by thread, and
+// threadFreeStatMap counts the releases of each thread.
+var threadMallocStatMap = make(map[threadStack]*ThreadMallocStat)
+var threadFreeStatMap = make(map[int32]*ThreadFreeStat)
+
+// memStatMutex guards the statistics maps and the track writer while a
+// record runs, as the live UI reads them besides the collector.
+var memStatMutex sync.Mutex
+
+// opKey identifies a live block, the address alone is not unique once
+// several processes are recorded or the records of several sources are
+// merged.
+type opKey struct {
+	Source uint16
+	Pid    int32
+	Addr   uintptr
+}
 
 type MallocStat struct {
-	Count int32
-	Byte  int64
-	Stack []string
+	Kind    AllocKind
+	Count   int64
+	Byte    int64
+	StackId uint32
 }
 
 type FreeStat struct {
-	Count int32
-	Stack []string
+	Kind    FreeKind
+	Count   int64
+	StackId uint32
+}
+
+// SourceMallocStat is the share of one merged source in a MallocStat.
+type SourceMallocStat struct {
+	Source  uint16
+	Count   int64
+	Byte    int64
+	StackId uint32
+}
+
+// MismatchStat counts blocks released by a function that does not match
+// the allocating one, e.g. new/free or malloc/delete.
+type MismatchStat struct {
+	Count         int64
+	Byte          int64
+	MallocKind    AllocKind
+	FreeKind      FreeKind
+	MallocStackId uint32
+	FreeStackId   uint32
+}
+
+type AllocKind uint8
+
+const (
+	AllocMalloc AllocKind = iota
+	AllocCalloc
+	AllocRealloc
+	AllocPosixMemalign
+	AllocAlignedAlloc
+	AllocMemalign
+	AllocValloc
+	AllocNew
+	AllocNewArray
+	AllocNewAligned
+	AllocNewArrayAligned
+)
+
+var allocKindNames = []string{
+	AllocMalloc:          "malloc",
+	AllocCalloc:          "calloc",
+	AllocRealloc:         "realloc",
+	AllocPosixMemalign:   "posix_memalign",
+	AllocAlignedAlloc:    "aligned_alloc",
+	AllocMemalign:        "memalign",
+	AllocValloc:          "valloc",
+	AllocNew:             "new",
+	AllocNewArray:        "new[]",
+	AllocNewAligned:      "new(align)",
+	AllocNewArrayAligned: "new[](align)",
+}
+
+type FreeKind uint8
+
+const (
+	FreeFree FreeKind = iota
+	FreeRealloc
+	FreeDelete
+	FreeDeleteArray
+	FreeDeleteSized
+	FreeDeleteArraySized
+	FreeDeleteAligned
+	FreeDeleteArrayAligned
+)
+
+var freeKindNames = []string{
+	FreeFree:               "free",
+	FreeRealloc:            "realloc",
+	FreeDelete:             "delete",
+	FreeDeleteArray:        "delete[]",
+	FreeDeleteSized:        "delete(sized)",
+	FreeDeleteArraySized:   "delete[](sized)",
+	FreeDeleteAligned:      "delete(align)",
+	FreeDeleteArrayAligned: "delete[](align)",
+}
+
+var allocKindByName = make(map[string]AllocKind)
+var freeKindByName = make(map[string]FreeKind)
+
+func init() {
+	for kind, name := range allocKindNames {
+		allocKindByName[name] = AllocKind(kind)
+	}
+	for kind, name := range freeKindNames {
+		freeKindByName[name] = FreeKind(kind)
+	}
+}
+
+func (k AllocKind) String() string {
+	if int(k) < len(allocKindNames) {
+		return allocKindNames[k]
+	}
+	return "unknown"
+}
+
+func (k FreeKind) String() string {
+	if int(k) < len(freeKindNames) {
+		return freeKindNames[k]
+	}
+	return "unknown"
+}
+
+// allocFamily groups the functions that may legally release each other's blocks.
+type allocFamily uint8
+
+const (
+	familyMalloc allocFamily = iota
+	familyNew
+	familyNewArray
+)
+
+func (k AllocKind) family() allocFamily {
+	switch k {
+	case AllocNew, AllocNewAligned:
+		return familyNew
+	case AllocNewArray, AllocNewArrayAligned:
+		return familyNewArray
+	}
+	return familyMalloc
+}
+
+func (k FreeKind) family() allocFamily {
+	switch k {
+	case FreeDelete, FreeDeleteSized, FreeDeleteAligned:
+		return familyNew
+	case FreeDeleteArray, FreeDeleteArraySized, FreeDeleteArrayAligned:
+		return familyNewArray
+	}
+	return familyMalloc
 }
 
 type MallocOp struct {
-	Byte      int64
-	Addr      uintptr
-	Stack     []string
-	StackHash uint32
+	Seq     uint64
+	Time    int64
+	Pid     int32
+	Tid     int32
+	Kind    AllocKind
+	Byte    int64
+	Addr    uintptr
+	OldAddr uintptr
+	StackId uint32
+	Source  uint16
+	// Weight is the number of allocations a sampled one stands for, zero
+	// when not sampled
+	Weight int64
+}
+
+func (m *MallocOp) weight() int64 {
+	if m.Weight > 1 {
+		return m.Weight
+	}
+	return 1
+}
+
+// weightedByte estimates the bytes of the allocations the op stands for.
+func (m *MallocOp) weightedByte() int64 {
+	return m.Byte * m.weight()
 }
 
 type FreeOp struct {
-	Addr      uintptr
-	Stack     []string
-	StackHash uint32
+	Seq     uint64
+	Time    int64
+	Pid     int32
+	Tid     int32
+	Kind    FreeKind
+	Addr    uintptr
+	StackId uint32
+	Source  uint16
+}
+
+// TraceEvent is one probed call, either an allocation or a release. Comm
+// is the name of the calling thread when the tracer reports it.
+type TraceEvent struct {
+	Malloc *MallocOp
+	Free   *FreeOp
+	Comm   string
+}
+
+func (e *TraceEvent) Seq() uint64 {
+	if e.Malloc != nil {
+		return e.Malloc.Seq
+	}
+	return e.Free.Seq
+}
+
+func (e *TraceEvent) Tid() int32 {
+	if e.Malloc != nil {
+		return e.Malloc.Tid
+	}
+	return e.Free.Tid
+}
+
+func (e *TraceEvent) Time() int64 {
+	if e.Malloc != nil {
+		return e.Malloc.Time
+	}
+	return e.Free.Time
 }
 
-func RecordProcessMem(pid int32) error {
+// RecordProcessMem records the processes of pids, the first one names the
+// track file. The processes matching m later on are attached as well.
+func RecordProcessMem(pids []int32, m *processMatcher) error {
 	if IsRootUser() == false {
 		return errors.New("not root user")
 	}
 	PrintVerboseInfo("check root user [ok]")
 
-	if IsProcessRunning(pid) == false {
-		return fmt.Errorf("process id(%d) not exist", pid)
+	for _, pid := range pids {
+		if IsProcessRunning(pid) == false {
+			return fmt.Errorf("process id(%d) not exist", pid)
+		}
 	}
 	PrintVerboseInfo("check process running [ok]")
 
-	err := checkSystemTapDependency()
+	tracer, err := NewTracer(RecordBackend)
+	if err != nil {
+		return err
+	}
+	err = tracer.CheckDependency()
 	if err != nil {
 		return err
 	}
-	PrintVerboseInfo("check systemtap dependency [ok]")
+	PrintVerboseInfo("check %s dependency [ok]", RecordBackend)
 
-	mc := make(chan *MallocOp, 100)
-	fc := make(chan *FreeOp, 100)
-	ec := make(chan error, 100)
-	probeMemoryOperation(pid, mc, fc, ec)
+	exe, _ := GetProcessExecutableFilePath(pids[0])
+	savePath, err := StartSave(RecordBackend, exe)
+	if err != nil {
+		return err
+	}
+	PrintVerboseInfo("save data to [%s] while recording", savePath)
+
+	evc, ec := newRecordChannels()
+	target := traceTarget{Pids: pids, FollowChildren: RecordFollowChildren, Watch: !m.empty()}
+	tracer.Start(target, evc, ec)
+	defer tracer.Stop()
+	if target.Watch {
+		stopWatch := make(chan struct{})
+		defer close(stopWatch)
+		go watchProcesses(m, pids, tracer, RecordFollowChildren, stopWatch)
+	}
 
 	color.Info.Prompt("start track memory...")
 	color.Info.Prompt("press [ctrl + C] stop")
 
+	if RecordLive {
+		return recordLiveTraceEvent(evc, ec)
+	}
+	return recordTraceEvent(evc, ec)
+}
+
+// recordLiveTraceEvent records in the background while the UI shows the
+// statistics collected so far, quitting the UI stops the record.
+func recordLiveTraceEvent(evc chan *TraceEvent, ec chan error) error {
+	done := make(chan struct{})
+	go func() {
+		applyRecordEvents(evc, ec)
+		close(done)
+	}()
+
+	uiErr := ShowLiveUI(done)
+	StopRecordMem()
+	<-done
+	err := saveRecord()
+	if uiErr != nil {
+		return uiErr
+	}
+	return err
+}
+
+// recordTraceEvent applies the probed events until the record is stopped,
+// then saves the data.
+func recordTraceEvent(evc chan *TraceEvent, ec chan error) error {
+	applyRecordEvents(evc, ec)
+	warnSampleEvictions()
+	return saveRecord()
+}
+
+// newRecordChannels makes the channels the collectors send the events and
+// the errors to, until the record stops.
+func newRecordChannels() (chan *TraceEvent, chan error) {
+	recordStopped = make(chan struct{})
+	return make(chan *TraceEvent, 100), make(chan error, 100)
+}
+
+// sendTraceEvent hands the event to the recorder, it is dropped once the
+// record stopped.
+func sendTraceEvent(evc chan *TraceEvent, ev *TraceEvent) {
+	select {
+	case evc <- ev:
+	case <-recordStopped:
+	}
+}
+
+// sendTraceError is sendTraceEvent for the errors of the tracer.
+func sendTraceError(ec chan error, err error) {
+	select {
+	case ec <- err:
+	case <-recordStopped:
+	}
+}
+
+func applyRecordEvents(evc chan *TraceEvent, ec chan error) {
 	setupStopTimer()
+	defer close(recordStopped)
+
+	flushTicker := time.NewTicker(trackFlushInterval)
+	defer flushTicker.Stop()
+	var snapshotTick <-chan time.Time
+	if RecordSnapshotInterval > 0 {
+		snapshotTicker := time.NewTicker(RecordSnapshotInterval)
+		defer snapshotTicker.Stop()
+		snapshotTick = snapshotTicker.C
+	}
 
+	sequencer := newEventSequencer()
 Loop:
 	for {
 		select {
 		case err := <-ec:
 			PrintVerboseInfo("probe: %v", err)
-		case free := <-fc:
-			addFreeOp(free)
-		case malloc := <-mc:
-			addMallocOp(malloc)
+		case ev := <-evc:
+			for _, e := range sequencer.push(ev) {
+				recordEvent(e)
+			}
+		case <-flushTicker.C:
+			memStatMutex.Lock()
+			FlushSave()
+			memStatMutex.Unlock()
+		case <-snapshotTick:
+			memStatMutex.Lock()
+			err := SnapshotSave()
+			memStatMutex.Unlock()
+			if err != nil {
+				PrintVerboseInfo("write snapshot: %v", err)
+			}
 		case <-stopRecord:
 			break Loop
 		default:
+			time.Sleep(time.Millisecond)
 		}
-		time.Sleep(time.Millisecond)
 	}
+	// apply the events already collected before stop
+Drain:
+	for {
+		select {
+		case ev := <-evc:
+			for _, e := range sequencer.push(ev) {
+				recordEvent(e)
+			}
+		default:
+			break Drain
+		}
+	}
+	for _, e := range sequencer.flush() {
+		recordEvent(e)
+	}
+}
 
+func saveRecord() error {
+	memStatMutex.Lock()
 	savePath, err := Save()
+	memStatMutex.Unlock()
 	if err != nil {
 		return err
 	}
@@ -92,7 +438,10 @@ Loop:
 }
 
 func StopRecordMem() {
-	stopRecord <- true
+	select {
+	case stopRecord <- true:
+	default:
+	}
 }
 
 func setupStopTimer() {
@@ -104,7 +453,9 @@ func setupStopTimer() {
 				select {
 				case <-timeTicker.C:
 					leftSecond--
-					color.Info.Prompt("finish after %d second...", leftSecond)
+					if !RecordLive {
+						color.Info.Prompt("finish after %d second...", leftSecond)
+					}
 					if leftSecond <= 0 {
 						StopRecordMem()
 					}
@@ -114,91 +465,170 @@ func setupStopTimer() {
 	}
 }
 
-func addMallocOp(m *MallocOp) {
-	if _, ok := mallocStatMap[m.StackHash]; ok {
-		mallocStatMap[m.StackHash].Count += 1
-		mallocStatMap[m.StackHash].Byte += m.Byte
-	} else {
-		mallocStatMap[m.StackHash] = &MallocStat{
-			Byte:  m.Byte,
-			Count: 1,
-			Stack: m.Stack,
-		}
+func recordEvent(e *TraceEvent) {
+	memStatMutex.Lock()
+	defer memStatMutex.Unlock()
+	e = filterRecordEvent(e)
+	if e == nil {
+		return
 	}
-	remainMallocOpMap[m.Addr] = m
+	setSampleWeight(e)
+	applyTraceEvent(e)
+	SaveTraceEvent(e)
 }
 
-func addFreeOp(f *FreeOp) {
-	if _, ok := freeStatMap[f.StackHash]; ok {
-		freeStatMap[f.StackHash].Count += 1
-	} else {
-		freeStatMap[f.StackHash] = &FreeStat{
-			Count: 1,
-			Stack: f.Stack,
-		}
-	}
-	delete(remainMallocOpMap, f.Addr)
+func resetMemStat() {
+	mallocStatMap = make(map[uint32]*MallocStat)
+	freeStatMap = make(map[uint32]*FreeStat)
+	remainMallocOpMap = make(map[opKey]*MallocOp)
+	mismatchStatMap = make(map[uint64]*MismatchStat)
+	sourceMallocStatMap = make(map[uint32][]*SourceMallocStat)
+	lifetimeStatMap = make(map[uint32]*LifetimeStat)
+	sizeStatMap = make(map[uint32]*SizeStat)
+	threadMallocStatMap = make(map[threadStack]*ThreadMallocStat)
+	threadFreeStatMap = make(map[int32]*ThreadFreeStat)
 }
 
-func probeMemoryOperation(pid int32, mc chan *MallocOp, fc chan *FreeOp, ec chan error) {
-	execFilePath, libstdcppPath, libcPath, err := getBinFilePath(pid)
-	if err != nil {
-		ec <- err
-		return
+func applyTraceEvent(e *TraceEvent) {
+	if len(e.Comm) > 0 {
+		threadNameMap[e.Tid()] = e.Comm
 	}
-
-	mallocCmdStr := buildMallocProbeCmdStr(pid, execFilePath, libcPath, libstdcppPath)
-	freeCmdStr := buildFreeProbeCmdStr(pid, execFilePath, libcPath, libstdcppPath)
-
-	mallocProbeCommand := exec.Command("/bin/sh", "-c", mallocCmdStr)
-	freeProbeCommand := exec.Command("/bin/sh", "-c", freeCmdStr)
-
-	mallocOutReader, mallocErrReader, err := getStdPipeReader(mallocProbeCommand)
-	if err != nil {
-		ec <- fmt.Errorf("get malloc pipe reader: %w", err)
-		return
+	if e.Free != nil {
+		addFreeOp(e.Free)
 	}
-
-	freeOutReader, freeErrReader, err := getStdPipeReader(freeProbeCommand)
-	if err != nil {
-		ec <- fmt.Errorf("get free pipe reader: %w", err)
-		return
+	if e.Malloc != nil {
+		addMallocOp(e.Malloc)
 	}
+}
 
-	err = mallocProbeCommand.Start()
-	if err != nil {
-		ec <- fmt.Errorf("malloc cmd start error: %w", err)
+func addMallocOp(m *MallocOp) {
+	// realloc frees the old block unless it failed (NULL return with non-zero size)
+	if m.Kind == AllocRealloc && m.OldAddr != 0 && (m.Addr != 0 || m.Byte == 0) {
+		addFreeOp(&FreeOp{
+			Seq:     m.Seq,
+			Time:    m.Time,
+			Pid:     m.Pid,
+			Tid:     m.Tid,
+			Kind:    FreeRealloc,
+			Addr:    m.OldAddr,
+			StackId: m.StackId,
+			Source:  m.Source,
+		})
+	}
+	// failed allocation, or realloc(ptr, 0) which only frees
+	if m.Addr == 0 {
 		return
 	}
+	if _, ok := mallocStatMap[m.StackId]; ok {
+		mallocStatMap[m.StackId].Count += m.weight()
+		mallocStatMap[m.StackId].Byte += m.weightedByte()
+	} else {
+		mallocStatMap[m.StackId] = &MallocStat{
+			Kind:    m.Kind,
+			Byte:    m.weightedByte(),
+			Count:   m.weight(),
+			StackId: m.StackId,
+		}
+	}
+	addSizeStat(m)
+	addThreadMallocStat(m)
+	remainMallocOpMap[opKey{m.Source, m.Pid, m.Addr}] = m
+}
 
-	err = freeProbeCommand.Start()
-	if err != nil {
-		ec <- fmt.Errorf("free cmd start error: %w", err)
-		return
+// addFreeOp counts the release with the weight of its block, only the
+// blocks of sampled allocations are released in a sampled record.
+func addFreeOp(f *FreeOp) {
+	key := opKey{f.Source, f.Pid, f.Addr}
+	m, ok := remainMallocOpMap[key]
+	weight := int64(1)
+	if ok {
+		weight = m.weight()
+	}
+	if _, ok := freeStatMap[f.StackId]; ok {
+		freeStatMap[f.StackId].Count += weight
+	} else {
+		freeStatMap[f.StackId] = &FreeStat{
+			Kind:    f.Kind,
+			Count:   weight,
+			StackId: f.StackId,
+		}
+	}
+	addThreadFreeStat(f, weight)
+	if ok {
+		if m.Kind.family() != f.Kind.family() {
+			addMismatch(m, f)
+		}
+		addLifetime(m, f)
 	}
+	delete(remainMallocOpMap, key)
+}
 
-	go checkErrReader(mallocErrReader, ec)
-	go checkErrReader(freeErrReader, ec)
-	go collectMallocOp(mallocOutReader, mc, ec)
-	go collectFreeOp(freeOutReader, fc, ec)
+// mismatchKey identifies the pair of allocating and releasing stacks.
+func mismatchKey(mallocStackId uint32, freeStackId uint32) uint64 {
+	return uint64(mallocStackId)<<32 | uint64(freeStackId)
+}
+
+func addMismatch(m *MallocOp, f *FreeOp) {
+	key := mismatchKey(m.StackId, f.StackId)
+	if _, ok := mismatchStatMap[key]; ok {
+		mismatchStatMap[key].Count += m.weight()
+		mismatchStatMap[key].Byte += m.weightedByte()
+	} else {
+		mismatchStatMap[key] = &MismatchStat{
+			Count:         m.weight(),
+			Byte:          m.weightedByte(),
+			MallocKind:    m.Kind,
+			FreeKind:      f.Kind,
+			MallocStackId: m.StackId,
+			FreeStackId:   f.StackId,
+		}
+	}
 }
 
 func checkErrReader(buf *bufio.Reader, ec chan error) {
 	for {
 		output, _, err := buf.ReadLine()
+		if isPipeClosed(err) {
+			return
+		}
 		if err == nil {
 			if strings.Index(string(output), "Missing separate debuginfos") < 0 {
-				ec <- fmt.Errorf("std err out put: %s", output)
+				sendTraceError(ec, fmt.Errorf("std err out put: %s", output))
 			}
 		} else {
-			if err.Error() != "EOF" {
-				ec <- fmt.Errorf("std err error: %w", err)
-			}
+			sendTraceError(ec, fmt.Errorf("std err error: %w", err))
 		}
 		time.Sleep(time.Millisecond)
 	}
 }
 
+// isPipeClosed tells whether the tracer output ended, the pipe is closed
+// by Wait once the tracer is stopped.
+func isPipeClosed(err error) bool {
+	return err == io.EOF || errors.Is(err, os.ErrClosed)
+}
+
+// stopCommand interrupts the tracer and waits for it to exit, it is killed
+// after TracerStopTimeout.
+func stopCommand(command *exec.Cmd) {
+	if command == nil || command.Process == nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		_ = command.Wait()
+		close(done)
+	}()
+	_ = command.Process.Signal(os.Interrupt)
+	select {
+	case <-done:
+	case <-time.After(TracerStopTimeout):
+		PrintVerboseInfo("tracer(%d) did not exit, kill it", command.Process.Pid)
+		_ = command.Process.Kill()
+		<-done
+	}
+}
+
 func getStdPipeReader(command *exec.Cmd) (*bufio.Reader, *bufio.Reader, error) {
 	stdOutPipe, err := command.StdoutPipe()
 	if err != nil {
@@ -215,81 +645,82 @@ func getStdPipeReader(command *exec.Cmd) (*bufio.Reader, *bufio.Reader, error) {
 	return stdOutReader, stdErrReader, nil
 }
 
-func getBinFilePath(pid int32) (string, string, string, error) {
-	execFilePath, err := GetProcessExecutableFilePath(pid)
+// writeProbeScript writes the script to a new temporary file only we can
+// write, the tracers run it as root.
+func writeProbeScript(pattern string, script string) (string, error) {
+	f, err := os.CreateTemp("", pattern)
 	if err != nil {
-		return "", "", "", fmt.Errorf("get exec file path error! pid(%d)\n %w", pid, err)
+		return "", fmt.Errorf("create probe script error: %w", err)
 	}
-	libcPath, err := GetDynamicDependencyPath(execFilePath, "libc")
-	if err != nil {
-		return "", "", "", fmt.Errorf("get libc path error! exec(%s)\n %w", execFilePath, err)
+	_, err = f.WriteString(script)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
 	}
-	libstdcppPath, err := GetDynamicDependencyPath(execFilePath, "libstdc\\+\\+")
 	if err != nil {
-		PrintDebugInfo("get libstdc++ path faild! exec(%s)\n %w", execFilePath, err)
+		_ = os.Remove(f.Name())
+		return "", fmt.Errorf("write probe script error: %w", err)
 	}
-	return execFilePath, libstdcppPath, libcPath, nil
+	return f.Name(), nil
 }
 
-func collectMallocOp(mallocOutReader *bufio.Reader, mc chan *MallocOp, ec chan error) {
-	var mallocOpBuf []string
-	isMallocOpRange := false
-	for {
-		output, _, err := mallocOutReader.ReadLine()
+func collectTraceEvent(outReader *bufio.Reader, evc chan *TraceEvent, ec chan error) {
+	readOperationBlock(outReader, ec, func(opStr []string) {
+		ev, err := parseOpStr(opStr)
 		if err != nil {
-			if err.Error() != "EOF" {
-				ec <- fmt.Errorf("malloc probe std out error: %w", err)
-			}
+			sendTraceError(ec, fmt.Errorf("parse op str error: %w", err))
 		} else {
-			if isOperationStartLine(string(output)) {
-				isMallocOpRange = true
-			} else if isOperationEndLine(string(output)) {
-				isMallocOpRange = false
-				op, err := parseMallocOpStr(mallocOpBuf)
-				if err != nil {
-					ec <- fmt.Errorf("parse malloc op str error: %w", err)
-				} else {
-					mc <- op
-				}
-				mallocOpBuf = mallocOpBuf[:0]
-			} else {
-				if isMallocOpRange {
-					mallocOpBuf = append(mallocOpBuf, string(output))
-				}
-			}
+			sendTraceEvent(evc, ev)
 		}
+	})
+}
+
+// readOperationBlock calls handle with the lines between every
+// OpStart/OpEnd pair of the tracer output, until the pipe is closed.
+func readOperationBlock(outReader *bufio.Reader, ec chan error, handle func(opStr []string)) {
+	readOperationLines(outReader, handle, func(err error) bool {
+		sendTraceError(ec, fmt.Errorf("probe std out error: %w", err))
 		time.Sleep(time.Millisecond)
-	}
+		return true
+	})
+}
+
+// readFileOperationBlock is readOperationBlock for a file, which is read
+// until its end or the first read error.
+func readFileOperationBlock(reader *bufio.Reader, handle func(opStr []string)) error {
+	var readErr error
+	readOperationLines(reader, handle, func(err error) bool {
+		readErr = err
+		return false
+	})
+	return readErr
 }
 
-func collectFreeOp(freeOutReader *bufio.Reader, fc chan *FreeOp, ec chan error) {
-	var freeOpBuf []string
-	isFreeOpRange := false
+// readOperationLines reads the blocks until the end of the input, a read
+// error goes on only when onError returns true.
+func readOperationLines(reader *bufio.Reader, handle func(opStr []string), onError func(err error) bool) {
+	var opBuf []string
+	isOpRange := false
 	for {
-		output, _, err := freeOutReader.ReadLine()
+		output, _, err := reader.ReadLine()
+		if isPipeClosed(err) {
+			return
+		}
 		if err != nil {
-			if err.Error() != "EOF" {
-				ec <- fmt.Errorf("free probe std out error: %w", err)
+			if !onError(err) {
+				return
 			}
 		} else {
 			if isOperationStartLine(string(output)) {
-				isFreeOpRange = true
+				isOpRange = true
 			} else if isOperationEndLine(string(output)) {
-				isFreeOpRange = false
-				op, err := parseFreeOpStr(freeOpBuf)
-				if err != nil {
-					ec <- fmt.Errorf("parse free op str error: %w", err)
-					return
-				} else {
-					fc <- op
-				}
-				freeOpBuf = freeOpBuf[:0]
-			} else {
-				if isFreeOpRange {
-					freeOpBuf = append(freeOpBuf, string(output))
-				}
+				isOpRange = false
+				handle(opBuf)
+				opBuf = opBuf[:0]
+			} else if isOpRange {
+				opBuf = append(opBuf, string(output))
+			} else if string(output) == SampleEvictedLine {
+				atomic.AddInt64(&sampleEvictions, 1)
 			}
 		}
-		time.Sleep(time.Millisecond)
 	}
 }
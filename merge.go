@@ -0,0 +1,253 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gookit/color"
+	"math"
+	"path/filepath"
+	"strings"
+)
+
+type sourceStack struct {
+	Source  uint16
+	StackId uint32
+}
+
+// trackMerger sums the statistics of the loaded files. The stacks are
+// matched by their frames without the absolute addresses, so the records
+// of one binary in several processes add up despite address randomization.
+type trackMerger struct {
+	sources  []trackSource
+	stackIds map[string]uint32
+	msMap    map[uint32]*MallocStat
+	fsMap    map[uint32]*FreeStat
+	mmMap    map[uint64]*MismatchStat
+	moList   []*MallocOp
+	smMap    map[sourceStack]*SourceMallocStat
+	ltMap    map[uint32]*LifetimeStat
+	szMap    map[uint32]*SizeStat
+}
+
+// MergeTrack combines the track files into one at outPath, keeping the
+// share of each source file.
+func MergeTrack(outPath string, paths []string) error {
+	if len(paths) < 2 {
+		return errors.New("merge needs at least two track files")
+	}
+	m := &trackMerger{
+		stackIds: make(map[string]uint32),
+		msMap:    make(map[uint32]*MallocStat),
+		fsMap:    make(map[uint32]*FreeStat),
+		mmMap:    make(map[uint64]*MismatchStat),
+		smMap:    make(map[sourceStack]*SourceMallocStat),
+		ltMap:    make(map[uint32]*LifetimeStat),
+		szMap:    make(map[uint32]*SizeStat),
+	}
+	for _, path := range paths {
+		err := Load(path)
+		if err != nil {
+			return fmt.Errorf("load %s: %w", path, err)
+		}
+		err = m.add(path)
+		if err != nil {
+			return err
+		}
+		PrintVerboseInfo("merge [%s]", path)
+	}
+	m.apply()
+
+	w, err := createTrackWriter(outPath, m.header())
+	if err != nil {
+		return err
+	}
+	err = w.writeStats()
+	if err != nil {
+		_ = w.file.Close()
+		return err
+	}
+	err = w.close()
+	if err != nil {
+		return err
+	}
+	color.Info.Prompt("merge %d sources to [%s]", len(m.sources), outPath)
+	return nil
+}
+
+// stackId returns the merged stack matching the loaded stack.
+func (m *trackMerger) stackId(id uint32) uint32 {
+	key := mergeStackKey(getStack(id))
+	if merged, ok := m.stackIds[key]; ok {
+		return merged
+	}
+	m.stackIds[key] = id
+	return id
+}
+
+// mergeStackKey is the stack with the functions, their offsets and the
+// module names, which stay the same for the same build.
+func mergeStackKey(stack []string) string {
+	names := make([]string, 0, len(stack))
+	for _, frame := range stack {
+		_, funcName, moduleName, err := splitStackString(frame)
+		if err != nil {
+			names = append(names, frame)
+			continue
+		}
+		module := filepath.Base(strings.TrimSuffix(strings.TrimPrefix(moduleName, "["), "]"))
+		names = append(names, funcName+" "+module)
+	}
+	return strings.Join(names, "\n")
+}
+
+// add merges the loaded file, a merged file brings all its sources.
+func (m *trackMerger) add(path string) error {
+	base := len(m.sources)
+	merged := len(loadTrackHeader.Sources) > 0
+	sources := loadTrackHeader.Sources
+	if !merged {
+		sources = []trackSource{{
+			Path:      path,
+			Pid:       loadTrackHeader.Pid,
+			Exe:       loadTrackHeader.Exe,
+			Host:      loadTrackHeader.Host,
+			StartTime: loadTrackHeader.StartTime,
+			Tracer:    loadTrackHeader.Tracer,
+		}}
+	}
+	if base+len(sources) > math.MaxUint16 {
+		return fmt.Errorf("too many sources to merge: %d", base+len(sources))
+	}
+	m.sources = append(m.sources, sources...)
+
+	if merged {
+		for _, list := range sourceMallocStatMap {
+			for _, v := range list {
+				m.addSourceStat(uint16(base)+v.Source, m.stackId(v.StackId), v.Count, v.Byte)
+			}
+		}
+	} else {
+		for id, v := range mallocStatMap {
+			m.addSourceStat(uint16(base), m.stackId(id), v.Count, v.Byte)
+		}
+	}
+
+	for id, v := range mallocStatMap {
+		mergedId := m.stackId(id)
+		if s, ok := m.msMap[mergedId]; ok {
+			s.Count += v.Count
+			s.Byte += v.Byte
+		} else {
+			m.msMap[mergedId] = &MallocStat{Kind: v.Kind, Count: v.Count, Byte: v.Byte, StackId: mergedId}
+		}
+	}
+	for id, v := range freeStatMap {
+		mergedId := m.stackId(id)
+		if s, ok := m.fsMap[mergedId]; ok {
+			s.Count += v.Count
+		} else {
+			m.fsMap[mergedId] = &FreeStat{Kind: v.Kind, Count: v.Count, StackId: mergedId}
+		}
+	}
+	for _, v := range mismatchStatMap {
+		mallocId, freeId := m.stackId(v.MallocStackId), m.stackId(v.FreeStackId)
+		key := mismatchKey(mallocId, freeId)
+		if s, ok := m.mmMap[key]; ok {
+			s.Count += v.Count
+			s.Byte += v.Byte
+		} else {
+			s := *v
+			s.MallocStackId = mallocId
+			s.FreeStackId = freeId
+			m.mmMap[key] = &s
+		}
+	}
+	for id, v := range lifetimeStatMap {
+		mergedId := m.stackId(id)
+		s, ok := m.ltMap[mergedId]
+		if !ok {
+			s = &LifetimeStat{StackId: mergedId}
+			m.ltMap[mergedId] = s
+		}
+		s.Count += v.Count
+		s.Total = addLifetimeTotal(s.Total, v.Total, 1)
+		s.Short += v.Short
+		for i, count := range v.Buckets {
+			s.Buckets[i] += count
+		}
+	}
+	for id, v := range sizeStatMap {
+		mergedId := m.stackId(id)
+		s, ok := m.szMap[mergedId]
+		if !ok {
+			s = &SizeStat{Min: v.Min, Max: v.Max, StackId: mergedId}
+			m.szMap[mergedId] = s
+		}
+		if v.Min < s.Min {
+			s.Min = v.Min
+		}
+		if v.Max > s.Max {
+			s.Max = v.Max
+		}
+		for i := range v.Counts {
+			s.Counts[i] += v.Counts[i]
+			s.Bytes[i] += v.Bytes[i]
+		}
+	}
+	for _, op := range remainMallocOpMap {
+		op.StackId = m.stackId(op.StackId)
+		op.Source += uint16(base)
+		m.moList = append(m.moList, op)
+	}
+	return nil
+}
+
+func (m *trackMerger) addSourceStat(source uint16, stackId uint32, count int64, bytes int64) {
+	key := sourceStack{source, stackId}
+	if s, ok := m.smMap[key]; ok {
+		s.Count += count
+		s.Byte += bytes
+		return
+	}
+	m.smMap[key] = &SourceMallocStat{Source: source, Count: count, Byte: bytes, StackId: stackId}
+}
+
+// apply replaces the loaded statistics by the merged ones. The thread ids
+// are per process, so the thread statistics are left out.
+func (m *trackMerger) apply() {
+	resetMemStat()
+	mallocStatMap = m.msMap
+	freeStatMap = m.fsMap
+	mismatchStatMap = m.mmMap
+	lifetimeStatMap = m.ltMap
+	sizeStatMap = m.szMap
+	for _, op := range m.moList {
+		remainMallocOpMap[opKey{op.Source, op.Pid, op.Addr}] = op
+	}
+	for _, v := range m.smMap {
+		sourceMallocStatMap[v.StackId] = append(sourceMallocStatMap[v.StackId], v)
+	}
+}
+
+// header keeps the fields the sources have in common.
+func (m *trackMerger) header() *trackHeader {
+	header := &trackHeader{
+		Version: trackVersion,
+		Tracer:  "merge",
+		Sources: m.sources,
+		Exe:     m.sources[0].Exe,
+		Host:    m.sources[0].Host,
+	}
+	for _, source := range m.sources {
+		if source.Exe != header.Exe {
+			header.Exe = ""
+		}
+		if source.Host != header.Host {
+			header.Host = ""
+		}
+		if source.StartTime > 0 && (header.StartTime == 0 || source.StartTime < header.StartTime) {
+			header.StartTime = source.StartTime
+		}
+	}
+	return header
+}
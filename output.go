@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// reportSchemaVersion is bumped on any incompatible change of the JSON
+// report, fields may be added without a bump.
+const reportSchemaVersion = 1
+
+var reportFormatNames = []string{"tui", "text", "json", "csv"}
+
+type reportFrame struct {
+	Address  string `json:"address"`
+	Function string `json:"function"`
+	Offset   string `json:"offset,omitempty"`
+	Module   string `json:"module"`
+}
+
+type reportEntry struct {
+	Rank  int           `json:"rank"`
+	Kind  string        `json:"kind"`
+	Count int64         `json:"count"`
+	Bytes int64         `json:"bytes"`
+	Stack []reportFrame `json:"stack"`
+}
+
+type reportRanking struct {
+	Name    string        `json:"name"`
+	Title   string        `json:"title"`
+	SortBy  string        `json:"sort_by"`
+	Entries []reportEntry `json:"entries"`
+}
+
+type reportTrack struct {
+	Path      string `json:"path"`
+	Pid       int32  `json:"pid,omitempty"`
+	Exe       string `json:"exe,omitempty"`
+	Host      string `json:"host,omitempty"`
+	Tracer    string `json:"tracer,omitempty"`
+	StartTime string `json:"start_time,omitempty"`
+	// the counts and bytes of a sampled record are estimates
+	SampleRate  int64 `json:"sample_rate,omitempty"`
+	SampleBytes int64 `json:"sample_bytes,omitempty"`
+}
+
+type reportTotals struct {
+	AllocCount int64 `json:"alloc_count"`
+	AllocBytes int64 `json:"alloc_bytes"`
+	FreeCount  int64 `json:"free_count"`
+	LiveCount  int64 `json:"live_count"`
+	LiveBytes  int64 `json:"live_bytes"`
+}
+
+// reportSource is the share of a source in a merged track file.
+type reportSource struct {
+	Index  int         `json:"index"`
+	Track  reportTrack `json:"track"`
+	Totals statValues  `json:"totals"`
+}
+
+type reportOutput struct {
+	SchemaVersion int             `json:"schema_version"`
+	Track         reportTrack     `json:"track"`
+	Totals        reportTotals    `json:"totals"`
+	Sources       []reportSource  `json:"sources,omitempty"`
+	Rankings      []reportRanking `json:"rankings"`
+}
+
+// WriteReport prints the rankings of prepareData in the given format,
+// keeping the first top entries of each one unless top is 0.
+func WriteReport(w io.Writer, format string, top int) error {
+	prepareData()
+	output := buildReportOutput(top)
+	switch format {
+	case "text":
+		return writeTextReport(w, output)
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(output)
+	case "csv":
+		return writeCsvReport(w, output)
+	}
+	return fmt.Errorf("unknown report format: %s (%s)", format, strings.Join(reportFormatNames, "|"))
+}
+
+func buildReportOutput(top int) *reportOutput {
+	output := &reportOutput{
+		SchemaVersion: reportSchemaVersion,
+		Track:         newReportTrack(ReportInputPath),
+	}
+	for _, v := range mallocStatMap {
+		output.Totals.AllocCount += v.Count
+		output.Totals.AllocBytes += v.Byte
+	}
+	for _, v := range freeStatMap {
+		output.Totals.FreeCount += v.Count
+	}
+	for _, op := range remainMallocOpMap {
+		output.Totals.LiveCount += op.weight()
+		output.Totals.LiveBytes += op.weightedByte()
+	}
+
+	output.Sources = buildReportSources()
+	output.Rankings = []reportRanking{
+		buildReportRanking("top_byte", "Top Byte [malloc]", "bytes", mallocTopByteSlice, top),
+		buildReportRanking("top_count", "Top Count [malloc]", "count", mallocTopCountSlice, top),
+		buildReportRanking("top_byte_after_free", "Top Byte [malloc after free]", "bytes", mallocTopByteAfterFreeSlice, top),
+		buildReportRanking("top_count_after_free", "Top Count [malloc after free]", "count", mallocTopCountAfterFreeSlice, top),
+	}
+	return output
+}
+
+// newReportTrack describes the last loaded track file.
+func newReportTrack(path string) reportTrack {
+	track := reportTrack{
+		Path:        path,
+		Pid:         loadTrackHeader.Pid,
+		Exe:         loadTrackHeader.Exe,
+		Host:        loadTrackHeader.Host,
+		Tracer:      loadTrackHeader.Tracer,
+		SampleRate:  loadTrackHeader.SampleRate,
+		SampleBytes: loadTrackHeader.SampleBytes,
+	}
+	if loadTrackHeader.StartTime > 0 {
+		track.StartTime = time.Unix(0, loadTrackHeader.StartTime).Format(time.RFC3339)
+	}
+	return track
+}
+
+// buildReportSources sums the statistics by source of a merged file.
+func buildReportSources() []reportSource {
+	var sources []reportSource
+	for index, source := range loadTrackHeader.Sources {
+		track := reportTrack{
+			Path:   source.Path,
+			Pid:    source.Pid,
+			Exe:    source.Exe,
+			Host:   source.Host,
+			Tracer: source.Tracer,
+		}
+		if source.StartTime > 0 {
+			track.StartTime = time.Unix(0, source.StartTime).Format(time.RFC3339)
+		}
+		sources = append(sources, reportSource{Index: index, Track: track})
+	}
+	if len(sources) == 0 {
+		return nil
+	}
+	for _, list := range sourceMallocStatMap {
+		for _, v := range list {
+			if int(v.Source) < len(sources) {
+				sources[v.Source].Totals.AllocCount += v.Count
+				sources[v.Source].Totals.AllocBytes += v.Byte
+			}
+		}
+	}
+	for _, op := range remainMallocOpMap {
+		if int(op.Source) < len(sources) {
+			sources[op.Source].Totals.LiveCount += op.weight()
+			sources[op.Source].Totals.LiveBytes += op.weightedByte()
+		}
+	}
+	return sources
+}
+
+func buildReportRanking(name string, title string, sortBy string, slice []MallocStat, top int) reportRanking {
+	ranking := reportRanking{Name: name, Title: title, SortBy: sortBy, Entries: []reportEntry{}}
+	for index, elem := range slice {
+		if top > 0 && index >= top {
+			break
+		}
+		entry := reportEntry{
+			Rank:  index + 1,
+			Kind:  elem.Kind.String(),
+			Count: elem.Count,
+			Bytes: elem.Byte,
+			Stack: []reportFrame{},
+		}
+		for _, frame := range getStack(elem.StackId) {
+			entry.Stack = append(entry.Stack, buildReportFrame(frame))
+		}
+		ranking.Entries = append(ranking.Entries, entry)
+	}
+	return ranking
+}
+
+func buildReportFrame(rawStack string) reportFrame {
+	address, funcName, moduleName, err := splitStackString(rawStack)
+	if err != nil {
+		return reportFrame{Function: rawStack}
+	}
+	frame := reportFrame{
+		Address:  address,
+		Function: funcName,
+		Module:   strings.TrimSuffix(strings.TrimPrefix(moduleName, "["), "]"),
+	}
+	if index := strings.Index(funcName, "+"); index > 0 {
+		frame.Function, _ = cppFiltFuncName(funcName)
+		frame.Offset = funcName[index+1:]
+	}
+	return frame
+}
+
+func (f reportFrame) String() string {
+	return fmt.Sprintf("%s [%s] [%s]", f.Function, f.Address, f.Module)
+}
+
+func writeTextReport(w io.Writer, output *reportOutput) error {
+	_, err := fmt.Fprintf(w, "track: %s\n", output.Track.Path)
+	if err != nil {
+		return err
+	}
+	if len(output.Track.Exe) > 0 {
+		_, _ = fmt.Fprintf(w, "exe: %s pid: %d host: %s tracer: %s start: %s\n", output.Track.Exe, output.Track.Pid,
+			output.Track.Host, output.Track.Tracer, output.Track.StartTime)
+	}
+	if sampling := samplingTitle(); len(sampling) > 0 {
+		_, _ = fmt.Fprintf(w, "sampled: %s, counts and bytes are estimates\n", sampling)
+	}
+	_, _ = fmt.Fprintf(w, "alloc: %d times %d bytes, free: %d times, live: %d blocks %d bytes\n",
+		output.Totals.AllocCount, output.Totals.AllocBytes, output.Totals.FreeCount,
+		output.Totals.LiveCount, output.Totals.LiveBytes)
+	for _, source := range output.Sources {
+		_, _ = fmt.Fprintf(w, "source [%d] %s: alloc: %d times %d bytes, live: %d blocks %d bytes\n", source.Index, source.Track.Path,
+			source.Totals.AllocCount, source.Totals.AllocBytes, source.Totals.LiveCount, source.Totals.LiveBytes)
+	}
+	for _, ranking := range output.Rankings {
+		_, _ = fmt.Fprintf(w, "\n== %s ==\n", ranking.Title)
+		for _, entry := range ranking.Entries {
+			_, _ = fmt.Fprintf(w, "#%d %s count=%d bytes=%d\n", entry.Rank, entry.Kind, entry.Count, entry.Bytes)
+			for index, frame := range entry.Stack {
+				_, _ = fmt.Fprintf(w, "    [%d] %s\n", index, frame)
+			}
+		}
+	}
+	return nil
+}
+
+func writeCsvReport(w io.Writer, output *reportOutput) error {
+	writer := csv.NewWriter(w)
+	_ = writer.Write([]string{"ranking", "rank", "kind", "count", "bytes", "function", "module", "stack"})
+	for _, ranking := range output.Rankings {
+		for _, entry := range ranking.Entries {
+			var function, module string
+			var frames []string
+			if len(entry.Stack) > 0 {
+				function = entry.Stack[0].Function
+				module = entry.Stack[0].Module
+			}
+			for _, frame := range entry.Stack {
+				frames = append(frames, frame.String())
+			}
+			_ = writer.Write([]string{
+				ranking.Name,
+				strconv.Itoa(entry.Rank),
+				entry.Kind,
+				strconv.FormatInt(entry.Count, 10),
+				strconv.FormatInt(entry.Bytes, 10),
+				function,
+				module,
+				strings.Join(frames, " | "),
+			})
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Field numbers of the pprof profile.proto messages.
+const (
+	profileSampleType        = 1
+	profileSample            = 2
+	profileMapping           = 3
+	profileLocation          = 4
+	profileFunction          = 5
+	profileStringTable       = 6
+	profileTimeNanos         = 9
+	profileDurationNanos     = 10
+	profilePeriodType        = 11
+	profilePeriod            = 12
+	profileDefaultSampleType = 14
+
+	valueTypeType = 1
+	valueTypeUnit = 2
+
+	sampleLocationId = 1
+	sampleValue      = 2
+
+	mappingId           = 1
+	mappingMemoryStart  = 2
+	mappingMemoryLimit  = 3
+	mappingFilename     = 5
+	mappingHasFunctions = 7
+
+	locationId        = 1
+	locationMappingId = 2
+	locationAddress   = 3
+	locationLine      = 4
+
+	lineFunctionId = 1
+
+	functionId         = 1
+	functionName       = 2
+	functionSystemName = 3
+	functionFilename   = 4
+)
+
+// protoBuffer encodes protocol buffer fields, zero scalars are omitted as
+// proto3 does.
+type protoBuffer struct {
+	data []byte
+}
+
+func (b *protoBuffer) varint(x uint64) {
+	for x >= 0x80 {
+		b.data = append(b.data, byte(x)|0x80)
+		x >>= 7
+	}
+	b.data = append(b.data, byte(x))
+}
+
+func (b *protoBuffer) key(field int, wireType int) {
+	b.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+func (b *protoBuffer) uint64Field(field int, x uint64) {
+	if x == 0 {
+		return
+	}
+	b.key(field, 0)
+	b.varint(x)
+}
+
+func (b *protoBuffer) int64Field(field int, x int64) {
+	b.uint64Field(field, uint64(x))
+}
+
+func (b *protoBuffer) boolField(field int, x bool) {
+	if x {
+		b.uint64Field(field, 1)
+	}
+}
+
+func (b *protoBuffer) bytesField(field int, data []byte) {
+	b.key(field, 2)
+	b.varint(uint64(len(data)))
+	b.data = append(b.data, data...)
+}
+
+func (b *protoBuffer) packedUint64Field(field int, values []uint64) {
+	if len(values) == 0 {
+		return
+	}
+	packed := &protoBuffer{}
+	for _, x := range values {
+		packed.varint(x)
+	}
+	b.bytesField(field, packed.data)
+}
+
+func (b *protoBuffer) packedInt64Field(field int, values []int64) {
+	u := make([]uint64, len(values))
+	for i, x := range values {
+		u[i] = uint64(x)
+	}
+	b.packedUint64Field(field, u)
+}
+
+func (b *protoBuffer) messageField(field int, encode func(m *protoBuffer)) {
+	m := &protoBuffer{}
+	encode(m)
+	b.bytesField(field, m.data)
+}
+
+type pprofMapping struct {
+	id    uint64
+	file  string
+	start uint64
+	limit uint64
+}
+
+type pprofLocation struct {
+	id         uint64
+	mappingId  uint64
+	address    uint64
+	functionId uint64
+}
+
+type pprofFunction struct {
+	id         uint64
+	name       string
+	systemName string
+	file       string
+}
+
+type pprofSample struct {
+	locationIds []uint64
+	values      []int64
+}
+
+// pprofBuilder collects the profile tables, each frame string becomes a
+// location and each module a mapping.
+type pprofBuilder struct {
+	strings     []string
+	stringIndex map[string]int64
+	mappings    []*pprofMapping
+	mappingMap  map[string]*pprofMapping
+	locations   []*pprofLocation
+	locationMap map[string]*pprofLocation
+	functions   []*pprofFunction
+	functionMap map[string]*pprofFunction
+	samples     []pprofSample
+}
+
+func newPprofBuilder() *pprofBuilder {
+	b := &pprofBuilder{
+		stringIndex: make(map[string]int64),
+		mappingMap:  make(map[string]*pprofMapping),
+		locationMap: make(map[string]*pprofLocation),
+		functionMap: make(map[string]*pprofFunction),
+	}
+	b.str("")
+	return b
+}
+
+func (b *pprofBuilder) str(s string) int64 {
+	if index, ok := b.stringIndex[s]; ok {
+		return index
+	}
+	index := int64(len(b.strings))
+	b.strings = append(b.strings, s)
+	b.stringIndex[s] = index
+	return index
+}
+
+func (b *pprofBuilder) location(rawStack string) uint64 {
+	if l, ok := b.locationMap[rawStack]; ok {
+		return l.id
+	}
+	frame := buildReportFrame(rawStack)
+	address, _ := strconv.ParseUint(strings.TrimPrefix(frame.Address, "0x"), 16, 64)
+
+	m := b.mapping(frame.Module)
+	if m.limit == 0 || address < m.start {
+		m.start = address
+	}
+	if address >= m.limit {
+		m.limit = address + 1
+	}
+
+	name := foldedFrameName(rawStack)
+	f, ok := b.functionMap[name]
+	if !ok {
+		_, systemName, _, err := splitStackString(rawStack)
+		if err != nil {
+			systemName = name
+		}
+		if index := strings.Index(systemName, "+"); index > 0 {
+			systemName = systemName[:index]
+		}
+		f = &pprofFunction{id: uint64(len(b.functions) + 1), name: name, systemName: systemName, file: frame.Module}
+		b.functions = append(b.functions, f)
+		b.functionMap[name] = f
+	}
+
+	l := &pprofLocation{id: uint64(len(b.locations) + 1), mappingId: m.id, address: address, functionId: f.id}
+	b.locations = append(b.locations, l)
+	b.locationMap[rawStack] = l
+	return l.id
+}
+
+func (b *pprofBuilder) mapping(file string) *pprofMapping {
+	m, ok := b.mappingMap[file]
+	if !ok {
+		m = &pprofMapping{id: uint64(len(b.mappings) + 1), file: file}
+		b.mappings = append(b.mappings, m)
+		b.mappingMap[file] = m
+	}
+	return m
+}
+
+func (b *pprofBuilder) addSample(stack []string, values []int64) {
+	sample := pprofSample{values: values}
+	// leaf first, as the frames of a stack
+	for _, frame := range stack {
+		sample.locationIds = append(sample.locationIds, b.location(frame))
+	}
+	b.samples = append(b.samples, sample)
+}
+
+func (b *pprofBuilder) encode() []byte {
+	p := &protoBuffer{}
+	sampleTypes := [][2]string{
+		{"alloc_objects", "count"},
+		{"alloc_space", "bytes"},
+		{"inuse_objects", "count"},
+		{"inuse_space", "bytes"},
+	}
+	for _, st := range sampleTypes {
+		typeIndex, unitIndex := b.str(st[0]), b.str(st[1])
+		p.messageField(profileSampleType, func(m *protoBuffer) {
+			m.int64Field(valueTypeType, typeIndex)
+			m.int64Field(valueTypeUnit, unitIndex)
+		})
+	}
+	for _, s := range b.samples {
+		p.messageField(profileSample, func(m *protoBuffer) {
+			m.packedUint64Field(sampleLocationId, s.locationIds)
+			m.packedInt64Field(sampleValue, s.values)
+		})
+	}
+	for _, mapping := range b.mappings {
+		if mapping.limit == 0 {
+			continue
+		}
+		fileIndex := b.str(mapping.file)
+		p.messageField(profileMapping, func(m *protoBuffer) {
+			m.uint64Field(mappingId, mapping.id)
+			m.uint64Field(mappingMemoryStart, mapping.start)
+			m.uint64Field(mappingMemoryLimit, mapping.limit)
+			m.int64Field(mappingFilename, fileIndex)
+			m.boolField(mappingHasFunctions, true)
+		})
+	}
+	for _, l := range b.locations {
+		p.messageField(profileLocation, func(m *protoBuffer) {
+			m.uint64Field(locationId, l.id)
+			m.uint64Field(locationMappingId, l.mappingId)
+			m.uint64Field(locationAddress, l.address)
+			m.messageField(locationLine, func(line *protoBuffer) {
+				line.uint64Field(lineFunctionId, l.functionId)
+			})
+		})
+	}
+	for _, f := range b.functions {
+		nameIndex, systemNameIndex, fileIndex := b.str(f.name), b.str(f.systemName), b.str(f.file)
+		p.messageField(profileFunction, func(m *protoBuffer) {
+			m.uint64Field(functionId, f.id)
+			m.int64Field(functionName, nameIndex)
+			m.int64Field(functionSystemName, systemNameIndex)
+			m.int64Field(functionFilename, fileIndex)
+		})
+	}
+
+	spaceIndex, bytesIndex := b.str("space"), b.str("bytes")
+	defaultIndex := b.str("inuse_space")
+	// the string table goes last, once every string is in
+	for _, s := range b.strings {
+		p.bytesField(profileStringTable, []byte(s))
+	}
+	p.int64Field(profileTimeNanos, timelineStartTime())
+	p.int64Field(profileDurationNanos, timelineEndTime()-timelineStartTime())
+	p.messageField(profilePeriodType, func(m *protoBuffer) {
+		m.int64Field(valueTypeType, spaceIndex)
+		m.int64Field(valueTypeUnit, bytesIndex)
+	})
+	p.int64Field(profilePeriod, 1)
+	p.int64Field(profileDefaultSampleType, defaultIndex)
+	return p.data
+}
+
+// WritePprof writes the statistics as a gzipped pprof profile, with the
+// allocated and the still live objects and bytes of every stack.
+func WritePprof(w io.Writer) error {
+	type stackValue struct {
+		allocCount, allocByte, liveCount, liveByte int64
+	}
+	byStack := make(map[uint32]*stackValue)
+	get := func(id uint32) *stackValue {
+		v, ok := byStack[id]
+		if !ok {
+			v = &stackValue{}
+			byStack[id] = v
+		}
+		return v
+	}
+	for id, s := range mallocStatMap {
+		v := get(id)
+		v.allocCount += s.Count
+		v.allocByte += s.Byte
+	}
+	for _, op := range remainMallocOpMap {
+		v := get(op.StackId)
+		v.liveCount += op.weight()
+		v.liveByte += op.weightedByte()
+	}
+
+	ids := make([]uint32, 0, len(byStack))
+	for id := range byStack {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	b := newPprofBuilder()
+	// pprof takes the first mapping as the main binary
+	if len(loadTrackHeader.Exe) > 0 {
+		b.mapping(loadTrackHeader.Exe)
+	}
+	for _, id := range ids {
+		v := byStack[id]
+		b.addSample(getStack(id), []int64{v.allocCount, v.allocByte, v.liveCount, v.liveByte})
+	}
+
+	writer := gzip.NewWriter(w)
+	_, err := writer.Write(b.encode())
+	if err != nil {
+		return err
+	}
+	return writer.Close()
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	_ "embed"
+	"errors"
+	"fmt"
+	"github.com/gookit/color"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+//go:embed preload/memtrack_preload.c
+var preloadShimSource []byte
+
+// preloadDrainTimeout bounds the wait for the events still buffered in the
+// socket after the tracked process exited.
+const preloadDrainTimeout = 5 * time.Second
+
+// RunProcessMem starts the command with the preload shim, which hooks
+// malloc/free/realloc/calloc in process and needs neither root nor kernel tracing.
+func RunProcessMem(args []string) error {
+	if IsCommandAvailable("cc") == false {
+		return errors.New("require install [gcc]")
+	}
+	PrintVerboseInfo("check compiler [ok]")
+
+	workDir, err := ioutil.TempDir("", "memory-track")
+	if err != nil {
+		return fmt.Errorf("create work dir error: %w", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	shimPath, err := buildPreloadShim(workDir)
+	if err != nil {
+		return err
+	}
+	PrintVerboseInfo("build preload shim [ok]")
+
+	sockPath := filepath.Join(workDir, "event.sock")
+	listener, err := net.Listen("unix", sockPath)
+	if err != nil {
+		return fmt.Errorf("listen unix socket error: %w", err)
+	}
+	defer listener.Close()
+
+	evc, ec := newRecordChannels()
+	var activeConn int32
+	go acceptPreloadConn(listener, evc, ec, &activeConn)
+
+	command := exec.Command(args[0], args[1:]...)
+	command.Stdin = os.Stdin
+	command.Stdout = os.Stdout
+	command.Stderr = os.Stderr
+	command.Env = append(os.Environ(), "LD_PRELOAD="+shimPath, "MEMORY_TRACK_SOCK="+sockPath)
+	err = command.Start()
+	if err != nil {
+		return fmt.Errorf("start command error: %w", err)
+	}
+	RecordPid = int32(command.Process.Pid)
+
+	savePath, err := StartSave("preload", args[0])
+	if err != nil {
+		_ = command.Process.Kill()
+		return err
+	}
+	PrintVerboseInfo("save data to [%s] while recording", savePath)
+
+	color.Info.Prompt("start track memory of process(%d)...", RecordPid)
+	color.Info.Prompt("press [ctrl + C] stop")
+
+	go func() {
+		err := command.Wait()
+		if err != nil {
+			color.Info.Prompt("process(%d) exit: %v", RecordPid, err)
+		} else {
+			color.Info.Prompt("process(%d) exit", RecordPid)
+		}
+		deadline := time.Now().Add(preloadDrainTimeout)
+		for atomic.LoadInt32(&activeConn) > 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		StopRecordMem()
+	}()
+
+	return recordTraceEvent(evc, ec)
+}
+
+func buildPreloadShim(workDir string) (string, error) {
+	sourcePath := filepath.Join(workDir, "memtrack_preload.c")
+	err := ioutil.WriteFile(sourcePath, preloadShimSource, 0644)
+	if err != nil {
+		return "", fmt.Errorf("write preload shim error: %w", err)
+	}
+	shimPath := filepath.Join(workDir, "libmemtrack_preload.so")
+	_, err = RunShellCommand(fmt.Sprintf("cc -shared -fPIC -O2 -o %s %s -ldl -lpthread", shimPath, sourcePath))
+	if err != nil {
+		return "", fmt.Errorf("build preload shim error: %w", err)
+	}
+	return shimPath, nil
+}
+
+func acceptPreloadConn(listener net.Listener, evc chan *TraceEvent, ec chan error, activeConn *int32) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			PrintDebugInfo("accept preload conn: %v", err)
+			return
+		}
+		atomic.AddInt32(activeConn, 1)
+		go func() {
+			defer atomic.AddInt32(activeConn, -1)
+			defer conn.Close()
+			collectTraceEvent(bufio.NewReader(conn), evc, ec)
+		}()
+	}
+}
@@ -0,0 +1,296 @@
+/*
+ * LD_PRELOAD shim of memory-track, hooks malloc/free/realloc/calloc and
+ * streams every call to the unix socket given by MEMORY_TRACK_SOCK, using
+ * the same text format as the stap probe script.
+ */
+#define _GNU_SOURCE
+#include <dlfcn.h>
+#include <execinfo.h>
+#include <pthread.h>
+#include <stdarg.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <sys/prctl.h>
+#include <sys/socket.h>
+#include <sys/syscall.h>
+#include <sys/un.h>
+#include <time.h>
+#include <unistd.h>
+
+#define MAX_FRAMES 64
+#define EVENT_BUF_SIZE 16384
+#define BOOTSTRAP_BUF_SIZE 65536
+
+static void *(*real_malloc)(size_t);
+static void (*real_free)(void *);
+static void *(*real_calloc)(size_t, size_t);
+static void *(*real_realloc)(void *, size_t);
+
+static int sock_fd = -1;
+static unsigned long long seq;
+static pthread_mutex_t sock_lock = PTHREAD_MUTEX_INITIALIZER;
+static __thread int in_hook;
+
+/* dlsym may call calloc before the real one is resolved */
+static char bootstrap_buf[BOOTSTRAP_BUF_SIZE];
+static size_t bootstrap_used;
+
+static int is_bootstrap_ptr(void *ptr)
+{
+    return (char *)ptr >= bootstrap_buf && (char *)ptr < bootstrap_buf + BOOTSTRAP_BUF_SIZE;
+}
+
+static void *bootstrap_alloc(size_t size)
+{
+    size_t aligned = (size + 15) & ~(size_t)15;
+    if (bootstrap_used + aligned > BOOTSTRAP_BUF_SIZE) {
+        return NULL;
+    }
+    void *ptr = bootstrap_buf + bootstrap_used;
+    bootstrap_used += aligned;
+    return ptr;
+}
+
+static void resolve_real_functions(void)
+{
+    static int resolving;
+    if (resolving) {
+        return;
+    }
+    resolving = 1;
+    real_malloc = dlsym(RTLD_NEXT, "malloc");
+    real_free = dlsym(RTLD_NEXT, "free");
+    real_calloc = dlsym(RTLD_NEXT, "calloc");
+    real_realloc = dlsym(RTLD_NEXT, "realloc");
+    resolving = 0;
+}
+
+static void write_all(const char *buf, size_t len)
+{
+    while (len > 0) {
+        ssize_t n = write(sock_fd, buf, len);
+        if (n <= 0) {
+            close(sock_fd);
+            sock_fd = -1;
+            return;
+        }
+        buf += n;
+        len -= n;
+    }
+}
+
+static size_t append_format(char *buf, size_t used, const char *format, ...)
+{
+    if (used >= EVENT_BUF_SIZE) {
+        return used;
+    }
+    va_list ap;
+    va_start(ap, format);
+    int n = vsnprintf(buf + used, EVENT_BUF_SIZE - used, format, ap);
+    va_end(ap);
+    if (n < 0) {
+        return used;
+    }
+    used += (size_t)n;
+    return used < EVENT_BUF_SIZE ? used : EVENT_BUF_SIZE - 1;
+}
+
+static size_t append_stack(char *buf, size_t used)
+{
+    void *frames[MAX_FRAMES];
+    int depth = backtrace(frames, MAX_FRAMES);
+    /* frames[0] is send_event, frames[1] is the hook */
+    for (int i = 2; i < depth; i++) {
+        Dl_info info;
+        unsigned long addr = (unsigned long)frames[i];
+        if (dladdr(frames[i], &info) && info.dli_sname != NULL) {
+            used = append_format(buf, used, "0x%lx : %s+0x%lx/0x0 [%s]\n", addr, info.dli_sname,
+                                 addr - (unsigned long)info.dli_saddr, info.dli_fname);
+        } else if (info.dli_fname != NULL) {
+            used = append_format(buf, used, "0x%lx : 0x%lx+0x0/0x0 [%s]\n", addr,
+                                 addr - (unsigned long)info.dli_fbase, info.dli_fname);
+        } else {
+            used = append_format(buf, used, "0x%lx : 0x%lx+0x0/0x0 [unknown]\n", addr, addr);
+        }
+    }
+    return used;
+}
+
+/* header holds the operation specific lines, e.g. "op=free\nmem=%d\n" */
+__attribute__((noinline)) static void send_event(unsigned long long event_seq, const char *header)
+{
+    char buf[EVENT_BUF_SIZE];
+    char comm[17] = {0};
+    struct timespec ts;
+    clock_gettime(CLOCK_REALTIME, &ts);
+    /* the thread name may be changed at any time, so it is read per event */
+    prctl(PR_GET_NAME, comm);
+    size_t used = 0;
+    used = append_format(buf, used, "---===\nseq=%llu\ntime=%lld\npid=%ld\ntid=%ld\ncomm=%s\n%s***===\n", event_seq,
+                         (long long)ts.tv_sec * 1000000000LL + ts.tv_nsec, (long)getpid(), (long)syscall(SYS_gettid), comm,
+                         header);
+    used = append_stack(buf, used);
+    used = append_format(buf, used, "===***\n===---\n\n");
+
+    pthread_mutex_lock(&sock_lock);
+    if (sock_fd >= 0) {
+        write_all(buf, used);
+    }
+    pthread_mutex_unlock(&sock_lock);
+}
+
+/*
+ * The sequence number of a release is taken before the real call and the
+ * one of an allocation after it, so a block reused by another thread is
+ * always released before it is allocated again.
+ */
+static unsigned long long next_seq(void)
+{
+    return __atomic_add_fetch(&seq, 1, __ATOMIC_SEQ_CST);
+}
+
+static int tracking(void)
+{
+    return sock_fd >= 0 && !in_hook;
+}
+
+static void stop_tracking_in_child(void)
+{
+    /* the forked child shares the socket, its events would break the order */
+    sock_fd = -1;
+}
+
+__attribute__((constructor)) static void memtrack_init(void)
+{
+    resolve_real_functions();
+
+    in_hook = 1;
+    /* the first backtrace() call loads libgcc_s, which allocates */
+    void *frames[1];
+    backtrace(frames, 1);
+
+    const char *path = getenv("MEMORY_TRACK_SOCK");
+    if (path != NULL) {
+        int fd = socket(AF_UNIX, SOCK_STREAM, 0);
+        struct sockaddr_un addr;
+        memset(&addr, 0, sizeof(addr));
+        addr.sun_family = AF_UNIX;
+        strncpy(addr.sun_path, path, sizeof(addr.sun_path) - 1);
+        if (fd >= 0 && connect(fd, (struct sockaddr *)&addr, sizeof(addr)) == 0) {
+            sock_fd = fd;
+        } else if (fd >= 0) {
+            close(fd);
+        }
+    }
+    /* only the launched process is tracked, not the programs it executes */
+    unsetenv("LD_PRELOAD");
+    unsetenv("MEMORY_TRACK_SOCK");
+    pthread_atfork(NULL, NULL, stop_tracking_in_child);
+    in_hook = 0;
+}
+
+void *malloc(size_t size)
+{
+    if (real_malloc == NULL) {
+        resolve_real_functions();
+        if (real_malloc == NULL) {
+            return bootstrap_alloc(size);
+        }
+    }
+    void *ptr = real_malloc(size);
+    if (tracking()) {
+        in_hook = 1;
+        char header[128];
+        snprintf(header, sizeof(header), "op=malloc\nbytes=%zu\nreturn=0x%lx\n", size, (unsigned long)ptr);
+        send_event(next_seq(), header);
+        in_hook = 0;
+    }
+    return ptr;
+}
+
+void *calloc(size_t n, size_t elem_size)
+{
+    if (real_calloc == NULL) {
+        resolve_real_functions();
+        if (real_calloc == NULL) {
+            /* bootstrap_buf is zero initialized and never reused */
+            return bootstrap_alloc(n * elem_size);
+        }
+    }
+    void *ptr = real_calloc(n, elem_size);
+    if (tracking()) {
+        in_hook = 1;
+        char header[128];
+        snprintf(header, sizeof(header), "op=calloc\nbytes=%zu\nreturn=0x%lx\n", n * elem_size, (unsigned long)ptr);
+        send_event(next_seq(), header);
+        in_hook = 0;
+    }
+    return ptr;
+}
+
+void *realloc(void *old, size_t size)
+{
+    if (is_bootstrap_ptr(old)) {
+        void *ptr = malloc(size);
+        if (ptr != NULL) {
+            size_t left = bootstrap_buf + BOOTSTRAP_BUF_SIZE - (char *)old;
+            memcpy(ptr, old, size < left ? size : left);
+        }
+        return ptr;
+    }
+    if (real_realloc == NULL) {
+        resolve_real_functions();
+        if (real_realloc == NULL) {
+            return NULL;
+        }
+    }
+    if (!tracking()) {
+        return real_realloc(old, size);
+    }
+    /*
+     * the old block may be handed out to another thread as soon as
+     * real_realloc frees it, so its release is numbered before the call and
+     * sent apart from the allocation, numbered after the call
+     */
+    in_hook = 1;
+    unsigned long long free_seq = old != NULL ? next_seq() : 0;
+    void *ptr = real_realloc(old, size);
+    char header[128];
+    int freed = old != NULL && (ptr != NULL || size == 0);
+    if (freed) {
+        snprintf(header, sizeof(header), "op=realloc\nmem=%lu\n", (unsigned long)old);
+        send_event(free_seq, header);
+    }
+    /* realloc(ptr, 0) only frees, a failed realloc takes the unused number */
+    if (!freed || ptr != NULL) {
+        snprintf(header, sizeof(header), "op=realloc\nbytes=%zu\nreturn=0x%lx\n", size, (unsigned long)ptr);
+        send_event(freed || old == NULL ? next_seq() : free_seq, header);
+    }
+    in_hook = 0;
+    return ptr;
+}
+
+void free(void *ptr)
+{
+    if (ptr == NULL || is_bootstrap_ptr(ptr)) {
+        return;
+    }
+    if (real_free == NULL) {
+        resolve_real_functions();
+        if (real_free == NULL) {
+            return;
+        }
+    }
+    if (tracking()) {
+        in_hook = 1;
+        unsigned long long event_seq = next_seq();
+        real_free(ptr);
+        char header[128];
+        snprintf(header, sizeof(header), "op=free\nmem=%lu\n", (unsigned long)ptr);
+        send_event(event_seq, header);
+        in_hook = 0;
+        return;
+    }
+    real_free(ptr);
+}
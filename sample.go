@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gookit/color"
+	"math/rand"
+	"strconv"
+	"sync/atomic"
+)
+
+const (
+	// SampleLimit bounds the sampling parameters, stap randint takes no
+	// bigger range.
+	SampleLimit = 1 << 20
+
+	// SampleMapSize is the number of sampled live blocks the probes can
+	// remember, their releases are the only ones reported.
+	SampleMapSize = 1 << 18
+
+	// SampleEvictedLine is printed by the probes, out of the event blocks,
+	// for every sampled block they can not remember as the map is full.
+	SampleEvictedLine = "sample-evicted"
+)
+
+// sampleEvictions counts the SampleEvictedLine of the probes, the releases
+// of as many sampled blocks are lost, they look live.
+var sampleEvictions int64
+
+// An allocation is sampled with the probability 1/RecordSampleRate, and
+// with --sample-bytes N with the probability size/N below N bytes, which
+// samples one allocation every N bytes on average. The sampled allocation
+// then stands for the inverse of its probability, its weight.
+
+func recordSampling() bool {
+	return RecordSampleRate > 1 || RecordSampleBytes > 0
+}
+
+func checkRecordSampling() error {
+	if RecordSampleRate < 0 || RecordSampleRate > SampleLimit {
+		return fmt.Errorf("sample rate %d out of range [0, %d], 0 or 1 to record all", RecordSampleRate, SampleLimit)
+	}
+	if RecordSampleBytes < 0 || RecordSampleBytes > SampleLimit {
+		return fmt.Errorf("sample bytes %d out of range [0, %d], 0 to disable", RecordSampleBytes, SampleLimit)
+	}
+	return nil
+}
+
+// sampleWeight is the weight of a sampled allocation of size bytes. The
+// fraction of a weight below --sample-bytes is rounded up at random with
+// the probability of the fraction, so the weights stay unbiased.
+func sampleWeight(size int64) int64 {
+	rate := int64(1)
+	if RecordSampleRate > 1 {
+		rate = RecordSampleRate
+	}
+	if RecordSampleBytes <= 0 || size >= RecordSampleBytes {
+		return rate
+	}
+	if size <= 0 {
+		size = 1
+	}
+	weight := RecordSampleBytes / size
+	if rand.Int63n(size) < RecordSampleBytes%size {
+		weight++
+	}
+	return rate * weight
+}
+
+// setSampleWeight weights the allocation of a sampled record.
+func setSampleWeight(e *TraceEvent) {
+	if recordSampling() && e.Malloc != nil {
+		e.Malloc.Weight = sampleWeight(e.Malloc.Byte)
+	}
+}
+
+// warnSampleEvictions tells about the sampled blocks the probes forgot.
+func warnSampleEvictions() {
+	if n := atomic.LoadInt64(&sampleEvictions); n > 0 {
+		color.Warn.Prompt("the probes forgot %d sampled blocks beyond %d live ones, their releases are lost and they look live, sample less",
+			n, SampleMapSize)
+	}
+}
+
+// buildSampleFuncStr is the stap function telling whether an allocation of
+// bytes is sampled, and the functions remembering the sampled blocks. The
+// sampled array wraps when full, dropping an old block, which is counted
+// by sample_keep.
+func buildSampleFuncStr() string {
+	size := strconv.Itoa(SampleMapSize)
+	script := "global sampled%[" + size + "]\n" +
+		"global sampled_count\n" +
+		"function sample_keep (pid:long, addr:long)\n" +
+		"{ " +
+		"if(!([pid, addr] in sampled)) " +
+		"{ " +
+		"if(sampled_count < " + size + ") sampled_count++; " +
+		"else printf(\"" + SampleEvictedLine + "\\n\"); " +
+		"} " +
+		"sampled[pid, addr] = 1; " +
+		"}\n" +
+		"function sample_forget (pid:long, addr:long)\n" +
+		"{ " +
+		"delete sampled[pid, addr]; " +
+		"sampled_count--; " +
+		"}\n" +
+		"function sample_alloc:long (bytes:long)\n" +
+		"{ "
+	if RecordSampleRate > 1 {
+		script += "if(randint(" + strconv.FormatInt(RecordSampleRate, 10) + ") != 0) return 0; "
+	}
+	if RecordSampleBytes > 0 {
+		script += "if(bytes < " + strconv.FormatInt(RecordSampleBytes, 10) + " && " +
+			"randint(" + strconv.FormatInt(RecordSampleBytes, 10) + ") >= (bytes > 0 ? bytes : 1)) return 0; "
+	}
+	return script + "return 1; }\n"
+}
+
+// buildSampledAllocPrintStr prints the allocation when it is sampled and
+// keeps its address for the release.
+func buildSampledAllocPrintStr(p allocProbe) string {
+	format := "op=" + p.Kind.String() + "\\n" + "bytes=%d\\n" + "return=0x%x\\n"
+	return "bytes = " + p.Bytes + "; ret = " + p.Return + "; " +
+		"if(sample_alloc(bytes)) " +
+		"{ " +
+		"if(ret != 0) sample_keep(pid(), ret); " +
+		buildPrintOpStr(format, "bytes, ret") +
+		"} "
+}
+
+func buildSampledFreePrintStr(p freeProbe) string {
+	return "if([pid(), " + p.Addr + "] in sampled) " +
+		"{ " +
+		"sample_forget(pid(), " + p.Addr + "); " +
+		buildPrintOpStr("op="+p.Kind.String()+"\\n"+"mem=%d\\n", p.Addr) +
+		"} "
+}
+
+// buildBpftraceSampleCond is the bpftrace condition telling whether an
+// allocation of bytes is sampled.
+func buildBpftraceSampleCond(bytes string) string {
+	var conds []string
+	if RecordSampleRate > 1 {
+		conds = append(conds, "rand % "+strconv.FormatInt(RecordSampleRate, 10)+" == 0")
+	}
+	if RecordSampleBytes > 0 {
+		sampleBytes := strconv.FormatInt(RecordSampleBytes, 10)
+		conds = append(conds, "("+bytes+" >= "+sampleBytes+" || rand % "+sampleBytes+" < ("+bytes+" > 0 ? "+bytes+" : 1))")
+	}
+	cond := ""
+	for i, c := range conds {
+		if i > 0 {
+			cond += " && "
+		}
+		cond += c
+	}
+	return cond
+}
+
+// buildBpftraceSampledAllocStr is the bpftrace version of
+// buildSampledAllocPrintStr. bpftrace maps do not wrap, a block is not
+// remembered when @sampled is full, it is counted the same way.
+func buildBpftraceSampledAllocStr(kind AllocKind, bytes string, ret string) string {
+	format := "op=" + kind.String() + "\\n" + "bytes=%lld\\n" + "return=0x%llx\\n"
+	return "$bytes = " + bytes + "; $ret = " + ret + "; " +
+		"if (" + buildBpftraceSampleCond("$bytes") + ") { " +
+		"if ($ret != 0 && !@sampled[pid, $ret]) { " +
+		"if (@sampled_count < " + strconv.Itoa(SampleMapSize) + ") { @sampled[pid, $ret] = 1; @sampled_count++; } " +
+		"else { printf(\"" + SampleEvictedLine + "\\n\"); } " +
+		"} " +
+		buildBpftracePrintStr(format, "$bytes, $ret") +
+		"} "
+}
+
+func buildBpftraceSampledFreeStr(kind FreeKind, addr string) string {
+	return "if (@sampled[pid, " + addr + "]) { " +
+		"delete(@sampled[pid, " + addr + "]); @sampled_count--; " +
+		buildBpftracePrintStr("op="+kind.String()+"\\n"+"mem=%lld\\n", addr) +
+		"} "
+}
+
+// samplingTitle describes the sampling of the loaded track file, empty
+// when every allocation was recorded.
+func samplingTitle() string {
+	title := ""
+	if loadTrackHeader.SampleRate > 1 {
+		title = fmt.Sprintf("1 of %d allocations", loadTrackHeader.SampleRate)
+	}
+	if loadTrackHeader.SampleBytes > 0 {
+		if len(title) > 0 {
+			title += ", "
+		}
+		title += fmt.Sprintf("1 every %d bytes", loadTrackHeader.SampleBytes)
+	}
+	return title
+}
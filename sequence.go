@@ -0,0 +1,139 @@
+package main
+
+import (
+	"container/heap"
+	"math"
+)
+
+// maxPendingEvents bounds the reorder buffer, when a sequence number is
+// still missing after that many later events it is treated as lost.
+const maxPendingEvents = 4096
+
+// eventSequencer restores the global order of the probed events by their
+// sequence number, the tracer output may interleave them out of order.
+type eventSequencer struct {
+	next    uint64
+	pending eventHeap
+}
+
+func newEventSequencer() *eventSequencer {
+	return &eventSequencer{next: 1}
+}
+
+// push adds an event and returns the events that are ready in order.
+func (s *eventSequencer) push(e *TraceEvent) []*TraceEvent {
+	// events without sequence number can not be reordered
+	if e.Seq() == 0 {
+		return []*TraceEvent{e}
+	}
+	if e.Seq() < s.next {
+		PrintDebugInfo("late event seq(%d), next seq(%d)", e.Seq(), s.next)
+		return []*TraceEvent{e}
+	}
+	heap.Push(&s.pending, e)
+
+	var ready []*TraceEvent
+	for s.pending.Len() > 0 {
+		top := s.pending[0]
+		if top.Seq() != s.next {
+			if s.pending.Len() <= maxPendingEvents {
+				break
+			}
+			PrintDebugInfo("lost events seq(%d - %d)", s.next, top.Seq()-1)
+			s.next = top.Seq()
+		}
+		ready = append(ready, heap.Pop(&s.pending).(*TraceEvent))
+		s.next++
+	}
+	return ready
+}
+
+// flush returns all pending events in order, ignoring the gaps.
+func (s *eventSequencer) flush() []*TraceEvent {
+	var ready []*TraceEvent
+	for s.pending.Len() > 0 {
+		e := heap.Pop(&s.pending).(*TraceEvent)
+		s.next = e.Seq() + 1
+		ready = append(ready, e)
+	}
+	return ready
+}
+
+type eventHeap []*TraceEvent
+
+func (h eventHeap) Len() int           { return len(h) }
+func (h eventHeap) Less(i, j int) bool { return h[i].Seq() < h[j].Seq() }
+func (h eventHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *eventHeap) Push(x interface{}) {
+	*h = append(*h, x.(*TraceEvent))
+}
+
+func (h *eventHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	*h = old[:n-1]
+	return e
+}
+
+// timeSequencer orders by time the events of a tracer which can not number
+// them, as events are read from the buffers of the CPUs in turn. An event
+// is held until it is older than the reorder window, so an earlier one read
+// later still comes first.
+type timeSequencer struct {
+	order   uint64
+	pending timedEventHeap
+}
+
+func newTimeSequencer() *timeSequencer {
+	return &timeSequencer{}
+}
+
+func (s *timeSequencer) push(e *TraceEvent) {
+	s.order++
+	heap.Push(&s.pending, timedEvent{event: e, order: s.order})
+}
+
+// pop returns in order the events at or before the time.
+func (s *timeSequencer) pop(before int64) []*TraceEvent {
+	var ready []*TraceEvent
+	for s.pending.Len() > 0 && s.pending[0].event.Time() <= before {
+		ready = append(ready, heap.Pop(&s.pending).(timedEvent).event)
+	}
+	return ready
+}
+
+// flush returns all pending events in order.
+func (s *timeSequencer) flush() []*TraceEvent {
+	return s.pop(math.MaxInt64)
+}
+
+// timedEvent keeps the read order of the events of the same time.
+type timedEvent struct {
+	event *TraceEvent
+	order uint64
+}
+
+type timedEventHeap []timedEvent
+
+func (h timedEventHeap) Len() int { return len(h) }
+func (h timedEventHeap) Less(i, j int) bool {
+	if h[i].event.Time() != h[j].event.Time() {
+		return h[i].event.Time() < h[j].event.Time()
+	}
+	return h[i].order < h[j].order
+}
+func (h timedEventHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *timedEventHeap) Push(x interface{}) {
+	*h = append(*h, x.(timedEvent))
+}
+
+func (h *timedEventHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	*h = old[:n-1]
+	return e
+}
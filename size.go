@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gookit/color"
+	"math/bits"
+	"sort"
+	"strings"
+)
+
+const (
+	// SizeBuckets is the size of the size histograms, bucket 0 holds the
+	// zero sizes and bucket i the sizes in [2^(i-1), 2^i), the last one
+	// everything bigger.
+	SizeBuckets = 41
+
+	SizeBarWidth = 20
+
+	// SizeClassStacks is the number of stacks listed in a size class detail.
+	SizeClassStacks = 5
+)
+
+// SizeStat is the size histogram of the blocks allocated by a stack.
+type SizeStat struct {
+	Min     int64
+	Max     int64
+	Counts  [SizeBuckets]int64
+	Bytes   [SizeBuckets]int64
+	StackId uint32
+}
+
+func addSizeStat(m *MallocOp) {
+	s, ok := sizeStatMap[m.StackId]
+	if !ok {
+		s = &SizeStat{Min: m.Byte, Max: m.Byte, StackId: m.StackId}
+		sizeStatMap[m.StackId] = s
+	}
+	if m.Byte < s.Min {
+		s.Min = m.Byte
+	}
+	if m.Byte > s.Max {
+		s.Max = m.Byte
+	}
+	bucket := sizeBucket(m.Byte)
+	s.Counts[bucket] += m.weight()
+	s.Bytes[bucket] += m.weightedByte()
+}
+
+func sizeBucket(size int64) int {
+	if size < 0 {
+		return 0
+	}
+	bucket := bits.Len64(uint64(size))
+	if bucket >= SizeBuckets {
+		bucket = SizeBuckets - 1
+	}
+	return bucket
+}
+
+func sizeBucketLabel(bucket int) string {
+	switch {
+	case bucket == 0:
+		return "0B"
+	case bucket == SizeBuckets-1:
+		return ">=" + formatByteSize(int64(1)<<(bucket-1))
+	}
+	return fmt.Sprintf("%s-%s", formatByteSize(int64(1)<<(bucket-1)), formatByteSize(int64(1)<<bucket-1))
+}
+
+// reportSizeRange tells whether a size filter is set.
+func reportSizeRange() bool {
+	return ReportMinSize > 0 || ReportMaxSize > 0
+}
+
+func inReportSizeRange(size int64) bool {
+	return size >= ReportMinSize && (ReportMaxSize <= 0 || size <= ReportMaxSize)
+}
+
+// warnReportSizeRange warns about the bounds of the report size range
+// falling inside a size class, the classes count only when the range
+// covers them entirely.
+func warnReportSizeRange() {
+	if ReportMinSize > 0 && ReportMinSize&(ReportMinSize-1) != 0 {
+		color.Warn.Prompt("--min-size %d is inside the size class %s, counted only where the range covers all its sizes, use a power of two",
+			ReportMinSize, sizeBucketLabel(sizeBucket(ReportMinSize)))
+	}
+	if ReportMaxSize > 0 && (ReportMaxSize+1)&ReportMaxSize != 0 {
+		color.Warn.Prompt("--max-size %d is inside the size class %s, counted only where the range covers all its sizes, use a power of two minus one",
+			ReportMaxSize, sizeBucketLabel(sizeBucket(ReportMaxSize)))
+	}
+}
+
+// inReportSizeBucket tells whether the bucket of the histogram is in the
+// report size range. The histogram has no exact sizes, so a bucket
+// counts when the range covers it entirely, except the range bounds
+// falling in the min or max of the stat.
+func inReportSizeBucket(s *SizeStat, bucket int) bool {
+	low, high := int64(0), int64(0)
+	if bucket > 0 {
+		low, high = int64(1)<<(bucket-1), int64(1)<<bucket-1
+	}
+	if low < s.Min {
+		low = s.Min
+	}
+	if high > s.Max || bucket == SizeBuckets-1 {
+		high = s.Max
+	}
+	return inReportSizeRange(low) && inReportSizeRange(high)
+}
+
+// inReportSizeClass tells whether a block of the stack is in the report
+// size range, by its size class as filterMallocStatBySize does, so the
+// live blocks agree with the allocations.
+func inReportSizeClass(stackId uint32, size int64) bool {
+	s, ok := sizeStatMap[stackId]
+	if !ok {
+		return inReportSizeRange(size)
+	}
+	return inReportSizeBucket(s, sizeBucket(size))
+}
+
+// filterMallocStatBySize keeps the allocations of the stat in the report
+// size range, by size class. Without a histogram the mean size decides.
+func filterMallocStatBySize(v MallocStat) MallocStat {
+	s, ok := sizeStatMap[v.StackId]
+	if !ok {
+		if v.Count == 0 || !inReportSizeRange(v.Byte/v.Count) {
+			v.Count = 0
+			v.Byte = 0
+		}
+		return v
+	}
+	v.Count = 0
+	v.Byte = 0
+	for bucket := range s.Counts {
+		if s.Counts[bucket] == 0 {
+			continue
+		}
+		if inReportSizeBucket(s, bucket) {
+			v.Count += s.Counts[bucket]
+			v.Byte += s.Bytes[bucket]
+		}
+	}
+	return v
+}
+
+// sizeDetail draws the size histogram of the stack.
+func sizeDetail(stackId uint32) []string {
+	s, ok := sizeStatMap[stackId]
+	if !ok {
+		return nil
+	}
+	var count, total int64
+	for bucket := range s.Counts {
+		count += s.Counts[bucket]
+		total += s.Bytes[bucket]
+	}
+	if count == 0 {
+		return nil
+	}
+	detail := []string{fmt.Sprintf("Size: min %s, max %s, mean %s", formatByteSize(s.Min), formatByteSize(s.Max), formatByteSize(total/count))}
+	return append(append(detail, sizeHistogram(s.Counts[:])...), "")
+}
+
+func sizeHistogram(counts []int64) []string {
+	first, last := -1, 0
+	var max int64
+	for i, count := range counts {
+		if count == 0 {
+			continue
+		}
+		if first < 0 {
+			first = i
+		}
+		last = i
+		if count > max {
+			max = count
+		}
+	}
+	var lines []string
+	for i := first; first >= 0 && i <= last; i++ {
+		bar := strings.Repeat("#", int((counts[i]*SizeBarWidth+max-1)/max))
+		lines = append(lines, fmt.Sprintf("  %15s %-*s %d", sizeBucketLabel(i), SizeBarWidth, bar, counts[i]))
+	}
+	return lines
+}
+
+// sizeClassRows is the distribution of all the allocations by size class,
+// with the stacks allocating the most in each class.
+func sizeClassRows() []mainRow {
+	var counts [SizeBuckets]int64
+	var bytes [SizeBuckets]int64
+	var totalCount, totalBytes int64
+	for _, s := range sizeStatMap {
+		for bucket := range s.Counts {
+			counts[bucket] += s.Counts[bucket]
+			bytes[bucket] += s.Bytes[bucket]
+			totalCount += s.Counts[bucket]
+			totalBytes += s.Bytes[bucket]
+		}
+	}
+
+	var rows []mainRow
+	for bucket := range counts {
+		if counts[bucket] == 0 {
+			continue
+		}
+		var stacks []*SizeStat
+		for _, s := range sizeStatMap {
+			if s.Counts[bucket] > 0 {
+				stacks = append(stacks, s)
+			}
+		}
+		sort.Slice(stacks, func(i, j int) bool {
+			if stacks[i].Counts[bucket] != stacks[j].Counts[bucket] {
+				return stacks[i].Counts[bucket] > stacks[j].Counts[bucket]
+			}
+			return stacks[i].StackId < stacks[j].StackId
+		})
+		bytesShare := 0.0
+		if totalBytes > 0 {
+			bytesShare = float64(bytes[bucket]) * 100 / float64(totalBytes)
+		}
+		detail := []string{
+			fmt.Sprintf("Count: %d (%.1f%%)", counts[bucket], float64(counts[bucket])*100/float64(totalCount)),
+			fmt.Sprintf("Bytes: %d (%.1f%%)", bytes[bucket], bytesShare),
+			"",
+			"Top stacks:",
+		}
+		for index, s := range stacks {
+			if index >= SizeClassStacks {
+				break
+			}
+			title := "unknown"
+			if stack := getStack(s.StackId); len(stack) > 0 {
+				title, _ = translateStackString(stack[0])
+			}
+			detail = append(detail, fmt.Sprintf("  %d times %s", s.Counts[bucket], title))
+		}
+		rows = append(rows, mainRow{
+			Title:  sizeBucketLabel(bucket),
+			Value:  fmt.Sprintf("%d", counts[bucket]),
+			Detail: detail,
+		})
+	}
+	return rows
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// trackSnapshot sums a statistics checkpoint of the loaded file, the
+// final one included. The live blocks are kept by stack to follow their
+// growth across the snapshots.
+type trackSnapshot struct {
+	Time   int64
+	Totals statValues
+	Live   map[uint32]statValues
+}
+
+// trackSnapshots are the checkpoints of the loaded file in file order,
+// numbered from 1.
+var trackSnapshots []trackSnapshot
+
+// addTrackSnapshot sums the statistics just restored from a checkpoint.
+func addTrackSnapshot(at int64) {
+	snapshot := trackSnapshot{Time: at, Live: make(map[uint32]statValues)}
+	for _, v := range mallocStatMap {
+		snapshot.Totals.AllocCount += v.Count
+		snapshot.Totals.AllocBytes += v.Byte
+	}
+	for _, op := range remainMallocOpMap {
+		live := snapshot.Live[op.StackId]
+		live.LiveCount += op.weight()
+		live.LiveBytes += op.weightedByte()
+		snapshot.Live[op.StackId] = live
+		snapshot.Totals.LiveCount += op.weight()
+		snapshot.Totals.LiveBytes += op.weightedByte()
+	}
+	trackSnapshots = append(trackSnapshots, snapshot)
+}
+
+// snapshotOffset is the snapshot time since the record start.
+func snapshotOffset(snapshot trackSnapshot) time.Duration {
+	if snapshot.Time == 0 {
+		return 0
+	}
+	return time.Duration(snapshot.Time - timelineStartTime()).Round(time.Millisecond)
+}
+
+// WriteSnapshotList prints the snapshots of the loaded file.
+func WriteSnapshotList(w io.Writer) error {
+	if len(trackSnapshots) == 0 {
+		_, err := fmt.Fprintln(w, "no snapshot in this track file")
+		return err
+	}
+	for index, snapshot := range trackSnapshots {
+		_, err := fmt.Fprintf(w, "#%d +%v alloc: %d times %d bytes, live: %d blocks %d bytes\n", index+1, snapshotOffset(snapshot),
+			snapshot.Totals.AllocCount, snapshot.Totals.AllocBytes, snapshot.Totals.LiveCount, snapshot.Totals.LiveBytes)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshotGrowthRows lists the stacks whose live bytes never drop from a
+// snapshot to the next and grow from the first one to the last, which is
+// the pattern of a leak, ranked by their growth.
+func snapshotGrowthRows() []mainRow {
+	if len(trackSnapshots) < 2 {
+		return nil
+	}
+	first := trackSnapshots[0]
+	last := trackSnapshots[len(trackSnapshots)-1]
+
+	type growth struct {
+		stackId uint32
+		delta   int64
+	}
+	var ranked []growth
+	for id, live := range last.Live {
+		monotonic := true
+		for i := 1; i < len(trackSnapshots) && monotonic; i++ {
+			monotonic = trackSnapshots[i].Live[id].LiveBytes >= trackSnapshots[i-1].Live[id].LiveBytes
+		}
+		if delta := live.LiveBytes - first.Live[id].LiveBytes; monotonic && delta > 0 {
+			ranked = append(ranked, growth{id, delta})
+		}
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].delta != ranked[j].delta {
+			return ranked[i].delta > ranked[j].delta
+		}
+		return ranked[i].stackId < ranked[j].stackId
+	})
+
+	var rows []mainRow
+	for _, g := range ranked {
+		var detail []string
+		for index, snapshot := range trackSnapshots {
+			live := snapshot.Live[g.stackId]
+			detail = append(detail, fmt.Sprintf("#%d +%v live %d blocks %d bytes", index+1, snapshotOffset(snapshot), live.LiveCount, live.LiveBytes))
+		}
+		detail = append(detail, "")
+		rows = append(rows, mainRow{
+			Value:   fmt.Sprintf("+%d", g.delta),
+			Stack:   getStack(g.stackId),
+			StackId: g.stackId,
+			Detail:  detail,
+		})
+	}
+	return rows
+}
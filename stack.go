@@ -0,0 +1,137 @@
+package main
+
+import "sync"
+
+// stackTable interns the recorded backtraces. Every distinct frame is kept
+// once and a stack is the list of its frame ids, so the ops and the stats
+// refer to their stack only by id. Stacks are looked up by a 64-bit hash
+// and compared frame by frame, so ids are never shared by two different
+// stacks. The collectors parse events in their own goroutines, hence the
+// lock.
+type stackTable struct {
+	mutex sync.Mutex
+	// hash is hashStackFrames, the tests replace it to force collisions
+	hash       func(frames []string) uint64
+	frames     []string
+	frameIndex map[string]uint32
+	stacks     [][]uint32
+	stackIndex map[uint64][]uint32
+}
+
+var globalStackTable = newStackTable()
+
+func newStackTable() *stackTable {
+	return &stackTable{
+		hash:       hashStackFrames,
+		frameIndex: make(map[string]uint32),
+		// id 0 is left unused, it stands for an unknown stack
+		stacks:     make([][]uint32, 1),
+		stackIndex: make(map[uint64][]uint32),
+	}
+}
+
+// internStack adds the stack to the table if needed and returns its id.
+func internStack(frames []string) uint32 {
+	return globalStackTable.intern(frames)
+}
+
+// getStack returns the frames of the stack, nil for an unknown id.
+func getStack(id uint32) []string {
+	return globalStackTable.stack(id)
+}
+
+func (t *stackTable) intern(frames []string) uint32 {
+	hash := t.hash(frames)
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, id := range t.stackIndex[hash] {
+		if t.equalFrames(t.stacks[id], frames) {
+			return id
+		}
+	}
+	frameIds := make([]uint32, len(frames))
+	for i, frame := range frames {
+		frameIds[i] = t.internFrame(frame)
+	}
+	id := uint32(len(t.stacks))
+	t.stacks = append(t.stacks, frameIds)
+	t.stackIndex[hash] = append(t.stackIndex[hash], id)
+	return id
+}
+
+func (t *stackTable) equalFrames(frameIds []uint32, frames []string) bool {
+	if len(frameIds) != len(frames) {
+		return false
+	}
+	for i, frameId := range frameIds {
+		if t.frames[frameId] != frames[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *stackTable) internFrame(frame string) uint32 {
+	if id, ok := t.frameIndex[frame]; ok {
+		return id
+	}
+	id := uint32(len(t.frames))
+	t.frames = append(t.frames, frame)
+	t.frameIndex[frame] = id
+	return id
+}
+
+func (t *stackTable) stack(id uint32) []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if id == 0 || int(id) >= len(t.stacks) {
+		return nil
+	}
+	frameIds := t.stacks[id]
+	frames := make([]string, len(frameIds))
+	for i, frameId := range frameIds {
+		frames[i] = t.frames[frameId]
+	}
+	return frames
+}
+
+func (t *stackTable) stackFrameIds(id uint32) []uint32 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if int(id) >= len(t.stacks) {
+		return nil
+	}
+	return t.stacks[id]
+}
+
+// framesFrom returns the frames interned since the first n ones.
+func (t *stackTable) framesFrom(n int) []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if n >= len(t.frames) {
+		return nil
+	}
+	frames := make([]string, len(t.frames)-n)
+	copy(frames, t.frames[n:])
+	return frames
+}
+
+const (
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+// hashStackFrames is FNV-1a over the frames, each one followed by a line
+// feed so a frame can't run into the next one.
+func hashStackFrames(frames []string) uint64 {
+	hash := uint64(fnvOffset64)
+	for _, frame := range frames {
+		for i := 0; i < len(frame); i++ {
+			hash ^= uint64(frame[i])
+			hash *= fnvPrime64
+		}
+		hash ^= '\n'
+		hash *= fnvPrime64
+	}
+	return hash
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Stacks sharing a hash are told apart by their frames.
+func TestStackTableHashCollision(t *testing.T) {
+	table := newStackTable()
+	table.hash = func(frames []string) uint64 { return 1 }
+
+	a := table.intern(stackAllocA)
+	b := table.intern(stackAllocB)
+	if a == 0 || b == 0 || a == b {
+		t.Fatalf("colliding stacks interned as %d and %d", a, b)
+	}
+	if id := table.intern(append([]string{}, stackAllocA...)); id != a {
+		t.Errorf("stack interned again as %d, want %d", id, a)
+	}
+	if id := table.intern(stackAllocA[:1]); id == a || id == b {
+		t.Errorf("stack prefix interned as %d", id)
+	}
+	if frames := table.stack(a); !reflect.DeepEqual(frames, stackAllocA) {
+		t.Errorf("stack %d is %v", a, frames)
+	}
+	if frames := table.stack(b); !reflect.DeepEqual(frames, stackAllocB) {
+		t.Errorf("stack %d is %v", b, frames)
+	}
+	if frames := table.stack(0); frames != nil {
+		t.Errorf("stack 0 is %v", frames)
+	}
+}
+
+// A frame can't run into the next one.
+func TestHashStackFrames(t *testing.T) {
+	if hashStackFrames([]string{"ab", "c"}) == hashStackFrames([]string{"a", "bc"}) {
+		t.Error("frames split differently hash the same")
+	}
+}
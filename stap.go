@@ -1,13 +1,193 @@
 package main
 
 import (
+	"bufio"
 	"errors"
+	"fmt"
 	"github.com/gookit/color"
-	"hash/crc32"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
+// stapTracer runs one stap for the libraries of the targets. A watched
+// target attaches the processes whose libraries are all probed through the
+// procfs file of the stap probing them, the other ones get a stap of their
+// own, the instances are then numbered on seq by the collectors. A process
+// is a target of one stap only, so none of its calls is reported twice.
+type stapTracer struct {
+	mutex     sync.Mutex
+	target    traceTarget
+	instances []*stapInstance
+	stopped   bool
+	seq       uint64
+	evc       chan *TraceEvent
+	ec        chan error
+}
+
+type stapInstance struct {
+	module     string
+	set        *probeSet
+	command    *exec.Cmd
+	scriptPath string
+}
+
+func newStapTracer() Tracer {
+	return &stapTracer{}
+}
+
+func (t *stapTracer) CheckDependency() error {
+	return checkSystemTapDependency()
+}
+
+func (t *stapTracer) Start(target traceTarget, evc chan *TraceEvent, ec chan error) {
+	t.target = target
+	t.evc = evc
+	t.ec = ec
+	set, err := newProbeSet(target.Pids)
+	if err == nil {
+		err = t.start(target, set)
+	}
+	if err != nil {
+		sendTraceError(ec, err)
+	}
+}
+
+func (t *stapTracer) start(target traceTarget, set *probeSet) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.stopped {
+		return errors.New("tracer stopped")
+	}
+
+	instance := &stapInstance{module: stapModuleName(len(t.instances)), set: set}
+	var err error
+	instance.scriptPath, err = writeProbeScript("memory-track-*.stp", buildProbeScript(target, set))
+	if err != nil {
+		return err
+	}
+	t.instances = append(t.instances, instance)
+
+	instance.command = exec.Command("stap", buildProbeCmdArgs(target, set, instance.module, instance.scriptPath)...)
+	outReader, errReader, err := getStdPipeReader(instance.command)
+	if err != nil {
+		return fmt.Errorf("get probe pipe reader: %w", err)
+	}
+
+	err = instance.command.Start()
+	if err != nil {
+		return fmt.Errorf("probe cmd start error: %w", err)
+	}
+
+	go checkErrReader(errReader, t.ec)
+	if target.Watch {
+		go collectStapEvent(outReader, &t.seq, t.evc, t.ec)
+	} else {
+		go collectTraceEvent(outReader, t.evc, t.ec)
+	}
+	return nil
+}
+
+// Attach writes the pids to the procfs file of the stap probing all their
+// libraries, read by the procfs write probe of the script, and starts a
+// stap for the other ones.
+func (t *stapTracer) Attach(pids []int32) error {
+	newSet := &probeSet{}
+	for _, pid := range pids {
+		b, err := resolveProcessBinaries(pid)
+		if err != nil {
+			return err
+		}
+		instance := t.covering(b)
+		if instance == nil {
+			newSet.add(pid, b)
+			continue
+		}
+		err = writeStapAttach(instance.module, []int32{pid})
+		if err != nil {
+			return err
+		}
+	}
+	if len(newSet.Pids) == 0 {
+		return nil
+	}
+	return t.start(traceTarget{Pids: newSet.Pids, FollowChildren: t.target.FollowChildren, Watch: true}, newSet)
+}
+
+func (t *stapTracer) covering(b processBinaries) *stapInstance {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, instance := range t.instances {
+		if instance.set.covers(b) {
+			return instance
+		}
+	}
+	return nil
+}
+
+func writeStapAttach(module string, pids []int32) error {
+	f, err := os.OpenFile(filepath.Join("/proc/systemtap", module, "attach"), os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("open attach file error: %w", err)
+	}
+	defer f.Close()
+	for _, pid := range pids {
+		_, err = f.WriteString(strconv.Itoa(int(pid)) + "\n")
+		if err != nil {
+			return fmt.Errorf("attach process(%d) error: %w", pid, err)
+		}
+	}
+	return nil
+}
+
+func (t *stapTracer) Stop() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.stopped = true
+	var wg sync.WaitGroup
+	for _, instance := range t.instances {
+		wg.Add(1)
+		go func(command *exec.Cmd) {
+			defer wg.Done()
+			stopCommand(command)
+		}(instance.command)
+	}
+	wg.Wait()
+	for _, instance := range t.instances {
+		_ = os.Remove(instance.scriptPath)
+	}
+}
+
+// collectStapEvent restores the order of the events of one stap by their
+// own seq, then numbers them on the seq shared by the instances.
+func collectStapEvent(outReader *bufio.Reader, seq *uint64, evc chan *TraceEvent, ec chan error) {
+	sequencer := newEventSequencer()
+	renumber := func(events []*TraceEvent) {
+		for _, ev := range events {
+			n := atomic.AddUint64(seq, 1)
+			if ev.Malloc != nil {
+				ev.Malloc.Seq = n
+			} else {
+				ev.Free.Seq = n
+			}
+			sendTraceEvent(evc, ev)
+		}
+	}
+	readOperationBlock(outReader, ec, func(opStr []string) {
+		ev, err := parseOpStr(opStr)
+		if err != nil {
+			sendTraceError(ec, fmt.Errorf("parse op str error: %w", err))
+			return
+		}
+		renumber(sequencer.push(ev))
+	})
+	renumber(sequencer.flush())
+}
+
 func checkSystemTapDependency() error {
 	if IsCommandAvailable("stap") == false {
 		return errors.New("require install [systemtap]")
@@ -39,50 +219,517 @@ func isOperationEndLine(line string) bool {
 	return line == OpEnd
 }
 
-func buildMallocProbeCmdStr(pid int32, execPath string, libCPath string, libStdCppPath string) string {
-	mallocCmdStr := "stap -v"
-	if len(libStdCppPath) > 0 {
-		mallocCmdStr += " -d " + libStdCppPath
+type allocProbe struct {
+	Kind     AllocKind
+	Function string
+	Bytes    string
+	Return   string
+	OldAddr  string
+	Cond     string
+}
+
+type freeProbe struct {
+	Kind     FreeKind
+	Function string
+	Addr     string
+}
+
+var allocProbes = []allocProbe{
+	{Kind: AllocMalloc, Function: "malloc", Bytes: "@entry($bytes)", Return: "$return"},
+	{Kind: AllocCalloc, Function: "calloc", Bytes: "@entry($n * $elem_size)", Return: "$return"},
+	{Kind: AllocRealloc, Function: "realloc", Bytes: "@entry($bytes)", Return: "$return", OldAddr: "$oldmem"},
+	{Kind: AllocPosixMemalign, Function: "posix_memalign", Bytes: "@entry($size)", Return: "user_long(@entry($memptr))", Cond: "$return == 0"},
+	{Kind: AllocAlignedAlloc, Function: "aligned_alloc", Bytes: "@entry($bytes)", Return: "$return"},
+	{Kind: AllocMemalign, Function: "memalign", Bytes: "@entry($bytes)", Return: "$return"},
+	{Kind: AllocValloc, Function: "valloc", Bytes: "@entry($bytes)", Return: "$return"},
+}
+
+var freeProbes = []freeProbe{
+	{Kind: FreeFree, Function: "free", Addr: "$mem"},
+}
+
+// libstdc++ usually comes without debuginfo, so operator new/delete are
+// probed by their mangled symbol names and read arguments from registers.
+var cxxAllocProbes = []allocProbe{
+	{Kind: AllocNew, Function: "_Znwm"},
+	{Kind: AllocNew, Function: "_ZnwmRKSt9nothrow_t"},
+	{Kind: AllocNewArray, Function: "_Znam"},
+	{Kind: AllocNewArray, Function: "_ZnamRKSt9nothrow_t"},
+	{Kind: AllocNewAligned, Function: "_ZnwmSt11align_val_t"},
+	{Kind: AllocNewAligned, Function: "_ZnwmSt11align_val_tRKSt9nothrow_t"},
+	{Kind: AllocNewArrayAligned, Function: "_ZnamSt11align_val_t"},
+	{Kind: AllocNewArrayAligned, Function: "_ZnamSt11align_val_tRKSt9nothrow_t"},
+}
+
+var cxxFreeProbes = []freeProbe{
+	{Kind: FreeDelete, Function: "_ZdlPv"},
+	{Kind: FreeDelete, Function: "_ZdlPvRKSt9nothrow_t"},
+	{Kind: FreeDeleteArray, Function: "_ZdaPv"},
+	{Kind: FreeDeleteArray, Function: "_ZdaPvRKSt9nothrow_t"},
+	{Kind: FreeDeleteSized, Function: "_ZdlPvm"},
+	{Kind: FreeDeleteArraySized, Function: "_ZdaPvm"},
+	{Kind: FreeDeleteAligned, Function: "_ZdlPvSt11align_val_t"},
+	{Kind: FreeDeleteAligned, Function: "_ZdlPvmSt11align_val_t"},
+	{Kind: FreeDeleteAligned, Function: "_ZdlPvSt11align_val_tRKSt9nothrow_t"},
+	{Kind: FreeDeleteArrayAligned, Function: "_ZdaPvSt11align_val_t"},
+	{Kind: FreeDeleteArrayAligned, Function: "_ZdaPvmSt11align_val_t"},
+	{Kind: FreeDeleteArrayAligned, Function: "_ZdaPvSt11align_val_tRKSt9nothrow_t"},
+}
+
+// cxxThrowFunction raises C++ exceptions. An operator new throwing
+// bad_alloc never returns, its depth is reset when it throws.
+const cxxThrowFunction = "__cxa_throw"
+
+func init() {
+	for i := range cxxAllocProbes {
+		cxxAllocProbes[i].Bytes = "@entry(ulong_arg(1))"
+		cxxAllocProbes[i].Return = "returnval()"
 	}
-	mallocCmdStr += " -d " + libCPath +
-		" -d " + execPath +
-		" -x " + strconv.Itoa(int(pid)) +
-		" -e " +
-		"'probe process(\"" + libCPath + "\").function(\"malloc\").return" +
-		"{ if(pid() == target()) " +
-		"{ " +
-		"printf(\"" + OpStart + "\\n" + "bytes=%d\\n" + "%s\\n" + StackStart + "\\n\"," + "@entry($bytes), $$return); " +
+	for i := range cxxFreeProbes {
+		cxxFreeProbes[i].Addr = "pointer_arg(1)"
+	}
+}
+
+// filterProbeFunctions keeps the functions exported by libPath, dropping
+// the ones that are an alias of an earlier function (e.g. aligned_alloc is
+// an alias of memalign in older glibc), otherwise both probes would fire
+// for the same call.
+func filterProbeFunctions(libPath string, functions []string) map[string]bool {
+	ret := make(map[string]bool)
+	symbolMap, err := GetDynamicSymbolAddressMap(libPath)
+	if err != nil {
+		PrintDebugInfo("get %s symbols failed: %v", libPath, err)
+		for _, f := range functions {
+			ret[f] = true
+		}
+		return ret
+	}
+	probedAddr := make(map[uint64]string)
+	for _, f := range functions {
+		addr, ok := symbolMap[f]
+		if !ok {
+			PrintDebugInfo("symbol %s not found in %s, skip probe", f, libPath)
+			continue
+		}
+		if name, ok := probedAddr[addr]; ok {
+			PrintDebugInfo("symbol %s is alias of %s, skip probe", f, name)
+			continue
+		}
+		probedAddr[addr] = f
+		ret[f] = true
+	}
+	return ret
+}
+
+func filterAllocProbes(libPath string, probes []allocProbe) []allocProbe {
+	var functions []string
+	for _, p := range probes {
+		functions = append(functions, p.Function)
+	}
+	available := filterProbeFunctions(libPath, functions)
+	var ret []allocProbe
+	for _, p := range probes {
+		if available[p.Function] {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+func filterFreeProbes(libPath string, probes []freeProbe) []freeProbe {
+	var functions []string
+	for _, p := range probes {
+		functions = append(functions, p.Function)
+	}
+	available := filterProbeFunctions(libPath, functions)
+	var ret []freeProbe
+	for _, p := range probes {
+		if available[p.Function] {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+// Every event carries a global sequence number, probe handlers are
+// serialized on the seq global so the collector can restore the true order.
+func buildPrintOpStr(format string, args string) string {
+	return buildPrintOpAtStr(format, args, "++seq", "gettimeofday_ns()")
+}
+
+// buildPrintOpAtStr prints an event numbered and timed earlier, as the
+// release of a realloc.
+func buildPrintOpAtStr(format string, args string, seq string, time string) string {
+	return "printf(\"" + OpStart + "\\n" + "seq=%d\\n" + "time=%d\\n" + "pid=%d\\n" + "tid=%d\\n" + "comm=%s\\n" + format + StackStart + "\\n\", " +
+		seq + ", " + time + ", pid(), tid(), execname(), " + args + "); " +
 		"print_ubacktrace(); " +
-		"printf(\"" + StackEnd + "\\n" + OpEnd + "\\n\\n\"); " +
+		"printf(\"" + StackEnd + "\\n" + OpEnd + "\\n\\n\"); "
+}
+
+func buildAllocPrintStr(p allocProbe) string {
+	if recordSampling() {
+		return buildSampledAllocPrintStr(p)
+	}
+	format := "op=" + p.Kind.String() + "\\n" + "bytes=%d\\n" + "return=0x%x\\n"
+	return buildPrintOpStr(format, p.Bytes+", "+p.Return)
+}
+
+func buildFreePrintStr(p freeProbe) string {
+	if recordSampling() {
+		return buildSampledFreePrintStr(p)
+	}
+	return buildPrintOpStr("op="+p.Kind.String()+"\\n"+"mem=%d\\n", p.Addr)
+}
+
+// stapTargetCond is the probe condition on the target processes, a single
+// one is the -x target, else they are kept in the targets array.
+func stapTargetCond(target traceTarget) string {
+	if target.single() {
+		return "pid() == target()"
+	}
+	return "(pid() in targets)"
+}
+
+// stapModuleName names the probe module of the index-th stap, its procfs
+// files are found under /proc/systemtap/<name>.
+func stapModuleName(index int) string {
+	return fmt.Sprintf("memory_track_%d_%d", os.Getpid(), index)
+}
+
+// buildTargetProbeStr fills the targets array, with the children forked by
+// a target once it runs when they are followed, and the pids written to
+// the attach file when the target is watched.
+func buildTargetProbeStr(target traceTarget) string {
+	script := "global targets\n" +
+		"probe begin\n" +
+		"{ "
+	for _, pid := range target.Pids {
+		script += "targets[" + strconv.Itoa(int(pid)) + "] = 1; "
+	}
+	script += "}\n"
+	if target.FollowChildren {
+		script += "probe kprocess.create\n" +
+			"{ if(pid() in targets) " +
+			"{ " +
+			"targets[new_pid] = 1; " +
+			"} " +
+			"}\n"
+	}
+	if target.Watch {
+		script += "probe procfs(\"attach\").write\n" +
+			"{ targets[strtol($value, 10)] = 1; }\n"
+	}
+	return script
+}
+
+// buildTidProbeStr fills the tids array with the --tid threads.
+func buildTidProbeStr() string {
+	script := "global tids\n" +
+		"probe begin\n" +
+		"{ "
+	for _, tid := range RecordTids {
+		script += "tids[" + strconv.Itoa(int(tid)) + "] = 1; "
+	}
+	return script + "}\n"
+}
+
+// stapTidCond keeps the allocations of the --tid threads in the probes.
+// The releases of realloc are not filtered, they may release a block of
+// those threads, the collector sorts them out as the other releases.
+func stapTidCond() string {
+	if len(RecordTids) == 0 {
+		return ""
+	}
+	return " && tid() in tids"
+}
+
+// The probes of libc skip the calls made from inside operator new/delete,
+// which are reported once by the libstdc++ probes instead.
+func buildAllocProbeStr(libCPath string, p allocProbe, targetCond string, cxx bool) string {
+	cond := targetCond
+	if cxx {
+		cond += " && cxx_alloc_depth[tid()] == 0"
+	}
+	if len(p.OldAddr) > 0 {
+		return buildReallocProbeStr(libCPath, p, cond)
+	}
+	cond += stapTidCond()
+	if len(p.Cond) > 0 {
+		cond += " && " + p.Cond
+	}
+	return "probe process(\"" + libCPath + "\").function(\"" + p.Function + "\").return\n" +
+		"{ if(" + cond + ") " +
+		"{ " +
+		buildAllocPrintStr(p) +
 		"} " +
-		"}'"
-	if Debug {
-		color.Debug.Println(mallocCmdStr)
+		"}\n"
+}
+
+// buildReallocProbeStr reports a realloc as the release of the old block
+// and the allocation of the new one, as the preload library does. The
+// release is numbered on entry, as the old block may be given to another
+// thread before realloc returns, and printed on return once realloc
+// succeeded. A failed realloc prints its allocation half with the number
+// instead, so that none is missing.
+func buildReallocProbeStr(libCPath string, p allocProbe, cond string) string {
+	reserve := p.OldAddr + " != 0"
+	forget := ""
+	keep := ""
+	if recordSampling() {
+		reserve = "[pid(), " + p.OldAddr + "] in sampled"
+		forget = "sample_forget(pid(), " + p.OldAddr + "); "
+		keep = "sample_keep(pid(), old); "
 	}
-	return mallocCmdStr
+	alloc := p
+	alloc.OldAddr = ""
+	failedFormat := "op=" + p.Kind.String() + "\\n" + "bytes=%d\\n" + "return=0x%x\\n"
+	return "probe process(\"" + libCPath + "\").function(\"" + p.Function + "\")\n" +
+		"{ if(" + cond + " && " + reserve + ") " +
+		"{ " +
+		forget +
+		"realloc_seq[tid()] = ++seq; " +
+		"realloc_time[tid()] = gettimeofday_ns(); " +
+		"} " +
+		"}\n" +
+		"probe process(\"" + libCPath + "\").function(\"" + p.Function + "\").return\n" +
+		"{ if(tid() in realloc_seq) " +
+		"{ " +
+		"rseq = realloc_seq[tid()]; rtime = realloc_time[tid()]; " +
+		"delete realloc_seq[tid()]; delete realloc_time[tid()]; " +
+		"old = @entry(" + p.OldAddr + "); bytes = " + p.Bytes + "; ret = " + p.Return + "; " +
+		"if(ret != 0 || bytes == 0) " +
+		"{ " +
+		buildPrintOpAtStr("op="+FreeRealloc.String()+"\\n"+"mem=%d\\n", "old", "rseq", "rtime") +
+		"if(ret != 0) { " + buildAllocPrintStr(alloc) + "} " +
+		"} " +
+		"else " +
+		"{ " +
+		keep +
+		buildPrintOpAtStr(failedFormat, "bytes, ret", "rseq", "rtime") +
+		"} " +
+		"} " +
+		"else if(" + cond + stapTidCond() + ") " +
+		"{ " +
+		buildAllocPrintStr(alloc) +
+		"} " +
+		"}\n"
 }
 
-func buildFreeProbeCmdStr(pid int32, execPath string, libCPath string, libStdCppPath string) string {
-	freeCmdStr := "stap -v"
-	if len(libStdCppPath) > 0 {
-		freeCmdStr += " -d " + libStdCppPath
+func buildFreeProbeStr(libCPath string, p freeProbe, targetCond string, cxx bool) string {
+	cond := targetCond
+	if cxx {
+		cond += " && cxx_free_depth[tid()] == 0"
 	}
-	freeCmdStr += " -d " + libCPath +
-		" -d " + execPath +
-		" -x " + strconv.Itoa(int(pid)) +
-		" -e " +
-		"'probe process(\"" + libCPath + "\").function(\"free\")" +
-		"{ if(pid() == target()) " +
+	return "probe process(\"" + libCPath + "\").function(\"" + p.Function + "\")\n" +
+		"{ if(" + cond + ") " +
 		"{ " +
-		"printf(\"" + OpStart + "\\n" + "mem=%d\\n" + StackStart + "\\n\"," + "$mem); " +
-		"print_ubacktrace(); " +
-		"printf(\"" + StackEnd + "\\n" + OpEnd + "\\n\\n\"); " +
+		buildFreePrintStr(p) +
+		"} " +
+		"}\n"
+}
+
+// operator new may call another operator new (e.g. the nothrow variant),
+// only the outermost call is reported.
+func buildCxxAllocProbeStr(libStdCppPath string, p allocProbe, targetCond string) string {
+	return "probe process(\"" + libStdCppPath + "\").function(\"" + p.Function + "\")\n" +
+		"{ if(" + targetCond + ") " +
+		"{ " +
+		"cxx_alloc_depth[tid()]++; " +
+		"} " +
+		"}\n" +
+		"probe process(\"" + libStdCppPath + "\").function(\"" + p.Function + "\").return\n" +
+		"{ if(" + targetCond + ") " +
+		"{ " +
+		"if(--cxx_alloc_depth[tid()] <= 0) " +
+		"{ " +
+		"delete cxx_alloc_depth[tid()]; " +
+		buildAllocPrintStr(p) +
+		"} " +
+		"} " +
+		"}\n"
+}
+
+func buildCxxThrowProbeStr(libStdCppPath string, targetCond string) string {
+	return "probe process(\"" + libStdCppPath + "\").function(\"" + cxxThrowFunction + "\")\n" +
+		"{ if(" + targetCond + ") " +
+		"{ " +
+		"delete cxx_alloc_depth[tid()]; " +
+		"} " +
+		"}\n"
+}
+
+func buildCxxFreeProbeStr(libStdCppPath string, p freeProbe, targetCond string) string {
+	return "probe process(\"" + libStdCppPath + "\").function(\"" + p.Function + "\")\n" +
+		"{ if(" + targetCond + ") " +
+		"{ " +
+		"if(cxx_free_depth[tid()]++ == 0) " +
+		"{ " +
+		buildFreePrintStr(p) +
 		"} " +
-		"}'"
+		"} " +
+		"}\n" +
+		"probe process(\"" + libStdCppPath + "\").function(\"" + p.Function + "\").return\n" +
+		"{ if(" + targetCond + ") " +
+		"{ " +
+		"if(--cxx_free_depth[tid()] <= 0) " +
+		"{ " +
+		"delete cxx_free_depth[tid()]; " +
+		"} " +
+		"} " +
+		"}\n"
+}
+
+// buildProbeScript probes each library of the set once, the libc probes
+// skip the calls of operator new/delete when libstdc++ is probed.
+func buildProbeScript(target traceTarget, set *probeSet) string {
+	script := "global seq\n"
+	script += "global realloc_seq\n"
+	script += "global realloc_time\n"
+	if !target.single() {
+		script += buildTargetProbeStr(target)
+	}
+	if len(RecordTids) > 0 {
+		script += buildTidProbeStr()
+	}
+	if recordSampling() {
+		script += buildSampleFuncStr()
+	}
+	targetCond := stapTargetCond(target)
+	cxx := len(set.LibStdCpps) > 0
+	if cxx {
+		script += "global cxx_alloc_depth\n"
+		script += "global cxx_free_depth\n"
+	}
+	for _, lib := range set.LibStdCpps {
+		for _, p := range filterAllocProbes(lib.Path, cxxAllocProbes) {
+			script += buildCxxAllocProbeStr(lib.Path, p, targetCond+stapTidCond())
+		}
+		for _, p := range filterFreeProbes(lib.Path, cxxFreeProbes) {
+			script += buildCxxFreeProbeStr(lib.Path, p, targetCond)
+		}
+		if filterProbeFunctions(lib.Path, []string{cxxThrowFunction})[cxxThrowFunction] {
+			script += buildCxxThrowProbeStr(lib.Path, targetCond)
+		}
+	}
+	for _, lib := range set.LibCs {
+		for _, p := range filterAllocProbes(lib.Path, allocProbes) {
+			script += buildAllocProbeStr(lib.Path, p, targetCond, cxx)
+		}
+		for _, p := range filterFreeProbes(lib.Path, freeProbes) {
+			script += buildFreeProbeStr(lib.Path, p, targetCond, cxx)
+		}
+	}
 	if Debug {
-		color.Debug.Println(freeCmdStr)
+		color.Debug.Println(script)
+	}
+	return script
+}
+
+// buildProbeCmdArgs are the stap arguments, they are passed without a
+// shell. The libraries and executables of the set are added for their
+// symbols.
+func buildProbeCmdArgs(target traceTarget, set *probeSet, module string, scriptPath string) []string {
+	args := []string{"-v"}
+	for _, lib := range set.LibStdCpps {
+		args = append(args, "-d", lib.Path)
+	}
+	for _, lib := range set.LibCs {
+		args = append(args, "-d", lib.Path)
+	}
+	for _, exe := range set.Exes {
+		args = append(args, "-d", exe)
+	}
+	if target.Watch {
+		args = append(args, "-m", module)
+	}
+	if target.single() {
+		args = append(args, "-x", strconv.Itoa(int(target.Pids[0])))
+	}
+	args = append(args, scriptPath)
+	if Debug {
+		color.Debug.Println("stap " + strings.Join(args, " "))
+	}
+	return args
+}
+
+// parseOpStr parses one event block, the "op" header tells whether it is
+// an allocation or a release. Blocks of the old separate malloc/free
+// scripts have no "op" header, a release is told by its "mem" header.
+func parseOpStr(opStr []string) (*TraceEvent, error) {
+	isFree := false
+	isBoth := false
+	hasOp := false
+	hasMem := false
+	comm := ""
+	for _, s := range opStr {
+		if s == StackStart {
+			break
+		}
+		if strings.HasPrefix(s, "comm=") {
+			comm = strings.TrimPrefix(s, "comm=")
+		}
+		if strings.HasPrefix(s, "op=") && !hasOp {
+			name := strings.TrimPrefix(s, "op=")
+			_, isAlloc := allocKindByName[name]
+			_, isFree = freeKindByName[name]
+			isBoth = isFree && isAlloc
+			isFree = isFree && !isAlloc
+			hasOp = true
+		}
+		if strings.HasPrefix(s, "mem=") {
+			hasMem = true
+		}
+	}
+	// an op named both ways, as realloc, is the release half when it
+	// reports mem instead of bytes
+	if hasMem && (!hasOp || isBoth) {
+		isFree = true
+	}
+	if isFree {
+		op, err := parseFreeOpStr(opStr)
+		if err != nil {
+			return nil, err
+		}
+		return &TraceEvent{Free: op, Comm: comm}, nil
+	}
+	op, err := parseMallocOpStr(opStr)
+	if err != nil {
+		return nil, err
+	}
+	return &TraceEvent{Malloc: op, Comm: comm}, nil
+}
+
+// parseEventHeader fills the fields shared by all events.
+func parseEventHeader(key string, value string, seq *uint64, t *int64, pid *int32, tid *int32) (bool, error) {
+	switch key {
+	case "seq":
+		v, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return true, err
+		}
+		*seq = v
+	case "time":
+		v, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return true, err
+		}
+		*t = v
+	case "pid":
+		v, err := strconv.ParseInt(value, 10, 32)
+		if err != nil {
+			return true, err
+		}
+		*pid = int32(v)
+	case "tid":
+		v, err := strconv.ParseInt(value, 10, 32)
+		if err != nil {
+			return true, err
+		}
+		*tid = int32(v)
+	default:
+		return false, nil
 	}
-	return freeCmdStr
+	return true, nil
 }
 
 func parseMallocOpStr(opStr []string) (*MallocOp, error) {
@@ -91,26 +738,63 @@ func parseMallocOpStr(opStr []string) (*MallocOp, error) {
 		PrintDebugInfo(s)
 	}
 
-	op := &MallocOp{}
-	b, err := strconv.Atoi(strings.TrimPrefix(opStr[0], "bytes="))
-	if err != nil {
-		return nil, err
+	op := &MallocOp{Kind: AllocMalloc}
+	index := 0
+	for ; index < len(opStr) && opStr[index] != StackStart; index++ {
+		kv := strings.SplitN(opStr[index], "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("malloc op header format error: %s", opStr[index])
+		}
+		if ok, err := parseEventHeader(kv[0], kv[1], &op.Seq, &op.Time, &op.Pid, &op.Tid); ok {
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		switch kv[0] {
+		case "op":
+			kind, ok := allocKindByName[kv[1]]
+			if !ok {
+				return nil, fmt.Errorf("unknown malloc op: %s", kv[1])
+			}
+			op.Kind = kind
+		case "bytes":
+			b, err := strconv.ParseInt(kv[1], 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			op.Byte = b
+		case "return":
+			a, err := strconv.ParseUint(strings.TrimPrefix(kv[1], "0x"), 16, 64)
+			if err != nil {
+				return nil, err
+			}
+			op.Addr = uintptr(a)
+		case "oldmem":
+			a, err := strconv.ParseUint(strings.TrimPrefix(kv[1], "0x"), 16, 64)
+			if err != nil {
+				return nil, err
+			}
+			op.OldAddr = uintptr(a)
+		}
 	}
-	op.Byte = int64(b)
-	a, err := strconv.ParseUint(strings.TrimPrefix(opStr[1], "return=0x"), 16, 64)
-	if err != nil {
-		return nil, err
+	if index >= len(opStr) {
+		return nil, fmt.Errorf("malloc op stack not found")
 	}
-	op.Addr = uintptr(a)
-	op.Stack = make([]string, len(opStr)-4)
-	copy(op.Stack, opStr[3:len(opStr)-1])
-	op.StackHash = hashCodeString(op.Stack)
+	if index == len(opStr)-1 || opStr[len(opStr)-1] != StackEnd {
+		return nil, fmt.Errorf("malloc op stack not terminated")
+	}
+	stack := opStr[index+1 : len(opStr)-1]
+	op.StackId = internStack(stack)
 
 	PrintDebugInfo("###### malloc operation parsed ######")
+	PrintDebugInfo("op.Seq=%d op.Time=%d op.Pid=%d op.Tid=%d", op.Seq, op.Time, op.Pid, op.Tid)
+	PrintDebugInfo("op.Kind=%s", op.Kind)
 	PrintDebugInfo("op.Byte=%d", op.Byte)
 	PrintDebugInfo("op.Addr=%d", op.Addr)
-	PrintDebugInfo("op.stackhash=%d", op.StackHash)
-	for _, s := range op.Stack {
+	PrintDebugInfo("op.OldAddr=%d", op.OldAddr)
+	PrintDebugInfo("op.StackId=%d", op.StackId)
+	for _, s := range stack {
 		PrintDebugInfo(s)
 	}
 	PrintDebugInfo("###### malloc operation end ######\n")
@@ -123,30 +807,51 @@ func parseFreeOpStr(opStr []string) (*FreeOp, error) {
 		PrintDebugInfo(s)
 	}
 
-	op := &FreeOp{}
-	a, err := strconv.ParseInt(strings.TrimPrefix(opStr[0], "mem="), 10, 64)
-	if err != nil {
-		return nil, err
+	op := &FreeOp{Kind: FreeFree}
+	index := 0
+	for ; index < len(opStr) && opStr[index] != StackStart; index++ {
+		kv := strings.SplitN(opStr[index], "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("free op header format error: %s", opStr[index])
+		}
+		if ok, err := parseEventHeader(kv[0], kv[1], &op.Seq, &op.Time, &op.Pid, &op.Tid); ok {
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		switch kv[0] {
+		case "op":
+			kind, ok := freeKindByName[kv[1]]
+			if !ok {
+				return nil, fmt.Errorf("unknown free op: %s", kv[1])
+			}
+			op.Kind = kind
+		case "mem":
+			a, err := strconv.ParseInt(kv[1], 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			op.Addr = uintptr(a)
+		}
 	}
-	op.Addr = uintptr(a)
-	op.Stack = make([]string, len(opStr)-3)
-	copy(op.Stack, opStr[2:len(opStr)-1])
-	op.StackHash = hashCodeString(op.Stack)
+	if index >= len(opStr) {
+		return nil, fmt.Errorf("free op stack not found")
+	}
+	if index == len(opStr)-1 || opStr[len(opStr)-1] != StackEnd {
+		return nil, fmt.Errorf("free op stack not terminated")
+	}
+	stack := opStr[index+1 : len(opStr)-1]
+	op.StackId = internStack(stack)
 
 	PrintDebugInfo("###### free operation parsed ######")
+	PrintDebugInfo("op.Seq=%d op.Time=%d op.Pid=%d op.Tid=%d", op.Seq, op.Time, op.Pid, op.Tid)
+	PrintDebugInfo("op.Kind=%s", op.Kind)
 	PrintDebugInfo("op.Addr=%d", op.Addr)
-	PrintDebugInfo("op.stackhash=%d", op.StackHash)
-	for _, s := range op.Stack {
+	PrintDebugInfo("op.StackId=%d", op.StackId)
+	for _, s := range stack {
 		PrintDebugInfo(s)
 	}
 	PrintDebugInfo("###### free operation end ######\n")
 	return op, nil
 }
-
-func hashCodeString(str []string) uint32 {
-	var buf string
-	for _, s := range str {
-		buf += s
-	}
-	return crc32.ChecksumIEEE([]byte(buf))
-}
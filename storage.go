@@ -1,65 +1,654 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
 	"encoding/gob"
+	"errors"
 	"fmt"
+	"github.com/gookit/color"
+	"hash/crc32"
+	"io"
 	"os"
 	"time"
 )
 
-type storageData struct {
-	MSMap map[uint32]*MallocStat
-	FSMap map[uint32]*FreeStat
-	MOMap map[uintptr]*MallocOp
+// Track file layout:
+//
+//	magic "MEMTRACK" | version uint32 | frame | frame | ...
+//	frame: length uint32 | crc32 uint32 | gob encoded trackRecord
+//
+// Frames are appended while recording, so a file cut by a crash or kill
+// stays readable up to its last complete frame. Files without the magic
+// are the version 0 format, a single gob encoded legacyStorageData.
+const (
+	trackMagic        = "MEMTRACK"
+	trackVersion      = 4
+	trackChunkEvents  = 4096
+	maxTrackFrameSize = 1 << 30
+)
+
+// trackFlushInterval is how often the buffered events are written to disk.
+const trackFlushInterval = time.Second
+
+type trackHeader struct {
+	Version   uint32
+	Pid       int32
+	Exe       string
+	Host      string
+	StartTime int64
+	Tracer    string
+	// SampleRate and SampleBytes are the record sampling, zero when every
+	// allocation was recorded
+	SampleRate  int64
+	SampleBytes int64
+	// Sources are the merged records, the ops refer to them by index
+	Sources []trackSource
 }
 
-func Save() (string, error) {
+type trackSource struct {
+	Path      string
+	Pid       int32
+	Exe       string
+	Host      string
+	StartTime int64
+	Tracer    string
+}
+
+// trackStats is a checkpoint of the statistics, the events written after
+// the last checkpoint are replayed on load.
+type trackStats struct {
+	Time   int64
+	MSMap  map[uint32]*MallocStat
+	FSMap  map[uint32]*FreeStat
+	MOList []*MallocOp
+	MMMap  map[uint64]*MismatchStat
+	SMList []*SourceMallocStat
+	LTList []*LifetimeStat
+	SZList []*SizeStat
+	TMList []*ThreadMallocStat
+	TFList []*ThreadFreeStat
+}
+
+// trackThread is the name of a thread, written with the events once it
+// is first seen or renamed.
+type trackThread struct {
+	Tid  int32
+	Comm string
+}
+
+// trackStack is a stack of the file, its frames are indexes into the
+// frames written so far.
+type trackStack struct {
+	Id       uint32
+	FrameIds []uint32
+}
+
+// trackRecord is the payload of a frame. The events are kept as compact
+// timeline entries referring to the stacks by id. Each frame and each
+// stack is written once, in the record where it first appears, and the
+// frames of a file are numbered in the order they are written.
+type trackRecord struct {
+	Header   *trackHeader
+	Frames   []string
+	Stacks   []trackStack
+	Timeline []trackEvent
+	Threads  []trackThread
+	Stats    *trackStats
+}
+
+type trackData struct {
+	Header trackHeader
+	MSMap  map[uint32]*MallocStat
+	FSMap  map[uint32]*FreeStat
+	MOMap  map[opKey]*MallocOp
+	MMMap  map[uint64]*MismatchStat
+}
+
+type trackWriter struct {
+	path           string
+	file           *os.File
+	writer         *bufio.Writer
+	events         []trackEvent
+	stacks         []trackStack
+	writtenStacks  map[uint32]bool
+	writtenFrames  int
+	threads        []trackThread
+	writtenThreads map[int32]string
+	eventCount     int
+}
+
+var saveTrack *trackWriter
+var loadTrackHeader trackHeader
+
+// StartSave creates the track file and writes its header, the recorded
+// events are appended by SaveTraceEvent until Save.
+func StartSave(tracer string, exe string) (string, error) {
 	saveFilePath := RecordOutPath
 	if len(saveFilePath) == 0 {
 		saveFilePath = fmt.Sprintf("%s-%d.track", time.Now().Format("20060102150405"), RecordPid)
 	}
+	host, _ := os.Hostname()
+	header := &trackHeader{
+		Version:     trackVersion,
+		Pid:         RecordPid,
+		Exe:         exe,
+		Host:        host,
+		StartTime:   time.Now().UnixNano(),
+		Tracer:      tracer,
+		SampleRate:  RecordSampleRate,
+		SampleBytes: RecordSampleBytes,
+	}
+	w, err := createTrackWriter(saveFilePath, header)
+	if err != nil {
+		return "", err
+	}
+	saveTrack = w
+	return saveFilePath, nil
+}
+
+func SaveTraceEvent(e *TraceEvent) {
+	if saveTrack == nil {
+		return
+	}
+	err := saveTrack.addEvent(e)
+	if err != nil {
+		PrintVerboseInfo("save event: %v", err)
+	}
+}
+
+func FlushSave() {
+	if saveTrack == nil {
+		return
+	}
+	err := saveTrack.flush()
+	if err != nil {
+		PrintVerboseInfo("flush track file: %v", err)
+	}
+}
 
-	if len(mallocStatMap) == 0 && len(freeStatMap) == 0 && len(remainMallocOpMap) == 0 {
+// SnapshotSave writes a statistics checkpoint without stopping the record,
+// so the track file opens with the data collected so far.
+func SnapshotSave() error {
+	if saveTrack == nil {
+		return errors.New("track file not created")
+	}
+	err := saveTrack.writeStats()
+	if err != nil {
+		return err
+	}
+	return saveTrack.writer.Flush()
+}
+
+// Save writes the final statistics checkpoint and closes the track file.
+func Save() (string, error) {
+	if saveTrack == nil {
+		return "", errors.New("track file not created")
+	}
+	w := saveTrack
+	saveTrack = nil
+
+	if w.eventCount == 0 {
+		_ = w.file.Close()
+		_ = os.Remove(w.path)
 		return "", fmt.Errorf("no data to save! (maybe time is too short)")
 	}
 
-	saveFile, err := os.OpenFile(saveFilePath, os.O_CREATE|os.O_WRONLY, 0666)
+	err := w.writeStats()
+	if err != nil {
+		_ = w.file.Close()
+		return "", err
+	}
+	err = w.close()
 	if err != nil {
-		return "", fmt.Errorf("open file error: %v", err)
+		return "", err
+	}
+	return w.path, nil
+}
+
+func Load(filename string) error {
+	return LoadSnapshot(filename, 0)
+}
+
+// LoadSnapshot loads the file as of its snapshot numbered from 1, the
+// events after it are left out. 0 loads the whole file.
+func LoadSnapshot(filename string, snapshot int) error {
+	data, err := loadTrackData(filename, snapshot)
+	if err != nil {
+		return err
+	}
+	loadTrackHeader = data.Header
+	if data.Header.Version > 0 {
+		PrintVerboseInfo("track of pid(%d) exe(%s) host(%s) tracer(%s) start at %s", data.Header.Pid, data.Header.Exe,
+			data.Header.Host, data.Header.Tracer, time.Unix(0, data.Header.StartTime).Format("2006-01-02 15:04:05"))
+	}
+	return nil
+}
+
+// loadTrackData loads the file into the recorder maps, which are
+// recreated so the maps of a previous load stay untouched.
+func loadTrackData(filename string, snapshot int) (*trackData, error) {
+	loadFile, err := os.OpenFile(filename, os.O_RDONLY, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("open file error: %v", err)
+	}
+	defer loadFile.Close()
+
+	resetMemStat()
+	resetTimeline()
+	trackSnapshots = nil
+	threadNameMap = make(map[int32]string)
+	data := &trackData{}
+
+	reader := bufio.NewReader(loadFile)
+	magic, err := reader.Peek(len(trackMagic))
+	if err != nil || string(magic) != trackMagic {
+		err = loadLegacyTrack(reader)
+	} else {
+		err = loadTrack(reader, data, snapshot)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if snapshot > len(trackSnapshots) {
+		return nil, fmt.Errorf("snapshot %d not found, the track file has %d", snapshot, len(trackSnapshots))
 	}
-	defer saveFile.Close()
 
-	data := storageData{}
 	data.MSMap = mallocStatMap
 	data.FSMap = freeStatMap
 	data.MOMap = remainMallocOpMap
+	data.MMMap = mismatchStatMap
+	return data, nil
+}
 
-	gobEncoder := gob.NewEncoder(saveFile)
-	err = gobEncoder.Encode(data)
+func loadLegacyTrack(reader io.Reader) error {
+	data := legacyStorageData{}
+	gobDecoder := gob.NewDecoder(reader)
+	err := gobDecoder.Decode(&data)
 	if err != nil {
-		return "", fmt.Errorf("gob encode error: %v", err)
+		return fmt.Errorf("gob decode error: %v", err)
 	}
+	restoreTrackStats(data.trackStats())
+	addTrackSnapshot(0)
+	return nil
+}
 
-	return saveFilePath, nil
+// trackLoader maps the frames and stack ids of a file to the stack table.
+// Before version 4 the stack ids were CRC32 hashes of the frames and
+// different stacks could share an id, they are interned again here.
+type trackLoader struct {
+	version      uint32
+	data         *trackData
+	frames       []string
+	stackIds     map[uint32]uint32
+	pendingStart int
 }
 
-func Load(filename string) error {
-	loadFile, err := os.OpenFile(filename, os.O_RDONLY, 0666)
+func loadTrack(reader *bufio.Reader, data *trackData, snapshot int) error {
+	preamble := make([]byte, len(trackMagic)+4)
+	_, err := io.ReadFull(reader, preamble)
 	if err != nil {
-		return fmt.Errorf("open file error: %v", err)
+		return fmt.Errorf("read track preamble error: %v", err)
 	}
-	defer loadFile.Close()
+	version := binary.BigEndian.Uint32(preamble[len(trackMagic):])
+	if version > trackVersion {
+		return fmt.Errorf("track version %d is newer than supported %d", version, trackVersion)
+	}
+	PrintVerboseInfo("track version %d", version)
+
+	l := &trackLoader{version: version, data: data, stackIds: make(map[uint32]uint32)}
+	for {
+		payload, err := readTrackFrame(reader)
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			if version < 3 {
+				err = l.loadLegacyRecord(payload)
+			} else {
+				err = l.loadRecord(payload)
+			}
+		}
+		if err != nil {
+			color.Warn.Prompt("track file truncated: %v", err)
+			break
+		}
+		if snapshot > 0 && len(trackSnapshots) == snapshot {
+			l.pendingStart = len(trackTimeline)
+			break
+		}
+	}
+
+	PrintVerboseInfo("replay %d events after the last checkpoint", len(trackTimeline)-l.pendingStart)
+	for _, e := range trackTimeline[l.pendingStart:] {
+		applyTrackEvent(e)
+	}
+	return nil
+}
 
-	data := storageData{}
-	gobDecoder := gob.NewDecoder(loadFile)
-	err = gobDecoder.Decode(&data)
+func (l *trackLoader) loadRecord(payload []byte) error {
+	record := &trackRecord{}
+	err := gob.NewDecoder(bytes.NewReader(payload)).Decode(record)
 	if err != nil {
 		return fmt.Errorf("gob decode error: %v", err)
 	}
+	if record.Header != nil {
+		l.data.Header = *record.Header
+	}
+	l.frames = append(l.frames, record.Frames...)
+	for _, thread := range record.Threads {
+		threadNameMap[thread.Tid] = thread.Comm
+	}
+	for _, stack := range record.Stacks {
+		frames := make([]string, len(stack.FrameIds))
+		for i, frameId := range stack.FrameIds {
+			if int(frameId) >= len(l.frames) {
+				return fmt.Errorf("stack %d refers to unknown frame %d", stack.Id, frameId)
+			}
+			frames[i] = l.frames[frameId]
+		}
+		l.stackIds[stack.Id] = internStack(frames)
+	}
+	if record.Stats != nil {
+		l.mapStats(record.Stats)
+		restoreTrackStats(record.Stats)
+		addTrackSnapshot(record.Stats.Time)
+		l.pendingStart = len(trackTimeline)
+	}
+	l.addTimeline(record.Timeline)
+	return nil
+}
+
+func (l *trackLoader) loadLegacyRecord(payload []byte) error {
+	record := &legacyTrackRecord{}
+	err := gob.NewDecoder(bytes.NewReader(payload)).Decode(record)
+	if err != nil {
+		return fmt.Errorf("gob decode error: %v", err)
+	}
+	if record.Header != nil {
+		l.data.Header = *record.Header
+	}
+	for _, stack := range record.Stacks {
+		l.stackIds[stack.Id] = internStack(stack.Frames)
+	}
+	// version 1 events hold their full stack, so replaying all of them
+	// separates the call sites its CRC32 keyed checkpoint merged
+	if record.Stats != nil && l.version > 1 {
+		restoreTrackStats(record.Stats.trackStats())
+		addTrackSnapshot(record.Stats.Time)
+		l.pendingStart = len(trackTimeline)
+	}
+	for _, e := range record.Events {
+		if te := e.traceEvent(); te != nil {
+			trackTimeline = append(trackTimeline, newTrackEvent(te))
+		}
+	}
+	l.addTimeline(record.Timeline)
+	return nil
+}
+
+func (l *trackLoader) addTimeline(timeline []trackEvent) {
+	for _, te := range timeline {
+		te.StackId = l.stackId(te.StackId)
+		trackTimeline = append(trackTimeline, te)
+	}
+}
+
+func (l *trackLoader) stackId(id uint32) uint32 {
+	if mapped, ok := l.stackIds[id]; ok {
+		return mapped
+	}
+	return id
+}
+
+// mapStats rewrites the stack ids of the checkpoint to the stack table.
+func (l *trackLoader) mapStats(stats *trackStats) {
+	for _, v := range stats.MSMap {
+		v.StackId = l.stackId(v.StackId)
+	}
+	for _, v := range stats.FSMap {
+		v.StackId = l.stackId(v.StackId)
+	}
+	for _, v := range stats.MMMap {
+		v.MallocStackId = l.stackId(v.MallocStackId)
+		v.FreeStackId = l.stackId(v.FreeStackId)
+	}
+	for _, op := range stats.MOList {
+		op.StackId = l.stackId(op.StackId)
+	}
+	for _, v := range stats.SMList {
+		v.StackId = l.stackId(v.StackId)
+	}
+	for _, v := range stats.LTList {
+		v.StackId = l.stackId(v.StackId)
+	}
+	for _, v := range stats.SZList {
+		v.StackId = l.stackId(v.StackId)
+	}
+	for _, v := range stats.TMList {
+		v.StackId = l.stackId(v.StackId)
+	}
+}
+
+// restoreTrackStats replaces the statistics by the checkpoint, the maps
+// are keyed by the stack ids of the stats.
+func restoreTrackStats(stats *trackStats) {
+	resetMemStat()
+	for _, v := range stats.MSMap {
+		mallocStatMap[v.StackId] = v
+	}
+	for _, v := range stats.FSMap {
+		freeStatMap[v.StackId] = v
+	}
+	for _, v := range stats.MMMap {
+		mismatchStatMap[mismatchKey(v.MallocStackId, v.FreeStackId)] = v
+	}
+	for _, op := range stats.MOList {
+		remainMallocOpMap[opKey{op.Source, op.Pid, op.Addr}] = op
+	}
+	for _, v := range stats.SMList {
+		sourceMallocStatMap[v.StackId] = append(sourceMallocStatMap[v.StackId], v)
+	}
+	for _, v := range stats.LTList {
+		lifetimeStatMap[v.StackId] = v
+	}
+	for _, v := range stats.SZList {
+		sizeStatMap[v.StackId] = v
+	}
+	for _, v := range stats.TMList {
+		threadMallocStatMap[threadStack{v.Tid, v.StackId}] = v
+	}
+	for _, v := range stats.TFList {
+		threadFreeStatMap[v.Tid] = v
+	}
+}
 
-	mallocStatMap = data.MSMap
-	freeStatMap = data.FSMap
-	remainMallocOpMap = data.MOMap
+func readTrackFrame(reader io.Reader) ([]byte, error) {
+	head := make([]byte, 8)
+	n, err := io.ReadFull(reader, head)
+	if err == io.EOF && n == 0 {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read frame head error: %v", err)
+	}
+	length := binary.BigEndian.Uint32(head)
+	checksum := binary.BigEndian.Uint32(head[4:])
+	if length > maxTrackFrameSize {
+		return nil, fmt.Errorf("frame length %d too large", length)
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(reader, payload)
+	if err != nil {
+		return nil, fmt.Errorf("read frame payload error: %v", err)
+	}
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return nil, errors.New("frame checksum mismatch")
+	}
+	return payload, nil
+}
 
+func createTrackWriter(path string, header *trackHeader) (*trackWriter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("open file error: %v", err)
+	}
+	w := &trackWriter{
+		path:           path,
+		file:           file,
+		writer:         bufio.NewWriter(file),
+		writtenStacks:  make(map[uint32]bool),
+		writtenThreads: make(map[int32]string),
+	}
+
+	preamble := make([]byte, len(trackMagic)+4)
+	copy(preamble, trackMagic)
+	binary.BigEndian.PutUint32(preamble[len(trackMagic):], trackVersion)
+	_, err = w.writer.Write(preamble)
+	if err == nil {
+		err = w.writeRecord(&trackRecord{Header: header})
+	}
+	if err == nil {
+		err = w.writer.Flush()
+	}
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("write track header error: %v", err)
+	}
+	return w, nil
+}
+
+func (w *trackWriter) writeRecord(record *trackRecord) error {
+	var payload bytes.Buffer
+	err := gob.NewEncoder(&payload).Encode(record)
+	if err != nil {
+		return fmt.Errorf("gob encode error: %v", err)
+	}
+	head := make([]byte, 8)
+	binary.BigEndian.PutUint32(head, uint32(payload.Len()))
+	binary.BigEndian.PutUint32(head[4:], crc32.ChecksumIEEE(payload.Bytes()))
+	_, err = w.writer.Write(head)
+	if err != nil {
+		return err
+	}
+	_, err = w.writer.Write(payload.Bytes())
+	return err
+}
+
+func (w *trackWriter) addEvent(e *TraceEvent) error {
+	te := newTrackEvent(e)
+	if !w.writtenStacks[te.StackId] {
+		w.writtenStacks[te.StackId] = true
+		w.stacks = append(w.stacks, trackStack{Id: te.StackId, FrameIds: globalStackTable.stackFrameIds(te.StackId)})
+	}
+	if len(e.Comm) > 0 && w.writtenThreads[te.Tid] != e.Comm {
+		w.writtenThreads[te.Tid] = e.Comm
+		w.threads = append(w.threads, trackThread{Tid: te.Tid, Comm: e.Comm})
+	}
+	w.events = append(w.events, te)
+	w.eventCount++
+	if len(w.events) >= trackChunkEvents {
+		return w.writeEvents()
+	}
 	return nil
 }
+
+func (w *trackWriter) writeEvents() error {
+	if len(w.events) == 0 {
+		return nil
+	}
+	frames := globalStackTable.framesFrom(w.writtenFrames)
+	err := w.writeRecord(&trackRecord{Frames: frames, Stacks: w.stacks, Timeline: w.events, Threads: w.threads})
+	w.writtenFrames += len(frames)
+	w.stacks = nil
+	w.events = nil
+	w.threads = nil
+	return err
+}
+
+// flush writes the buffered events, so they survive a crash of the recorder.
+func (w *trackWriter) flush() error {
+	err := w.writeEvents()
+	if err != nil {
+		return err
+	}
+	return w.writer.Flush()
+}
+
+func (w *trackWriter) writeStats() error {
+	err := w.writeEvents()
+	if err != nil {
+		return err
+	}
+	stats := &trackStats{
+		Time:  time.Now().UnixNano(),
+		MSMap: mallocStatMap,
+		FSMap: freeStatMap,
+		MMMap: mismatchStatMap,
+	}
+	for _, op := range remainMallocOpMap {
+		stats.MOList = append(stats.MOList, op)
+	}
+	for _, list := range sourceMallocStatMap {
+		stats.SMList = append(stats.SMList, list...)
+	}
+	for _, v := range lifetimeStatMap {
+		stats.LTList = append(stats.LTList, v)
+	}
+	for _, v := range sizeStatMap {
+		stats.SZList = append(stats.SZList, v)
+	}
+	for _, v := range threadMallocStatMap {
+		stats.TMList = append(stats.TMList, v)
+	}
+	for _, v := range threadFreeStatMap {
+		stats.TFList = append(stats.TFList, v)
+	}
+	err = w.writeStatsStacks(stats)
+	if err != nil {
+		return err
+	}
+	return w.writeRecord(&trackRecord{Stats: stats})
+}
+
+// writeStatsStacks writes the stacks of the stats not written with the
+// events, as in merged records which have no event.
+func (w *trackWriter) writeStatsStacks(stats *trackStats) error {
+	addStack := func(id uint32) {
+		if !w.writtenStacks[id] {
+			w.writtenStacks[id] = true
+			w.stacks = append(w.stacks, trackStack{Id: id, FrameIds: globalStackTable.stackFrameIds(id)})
+		}
+	}
+	for id := range stats.MSMap {
+		addStack(id)
+	}
+	for id := range stats.FSMap {
+		addStack(id)
+	}
+	for _, v := range stats.MMMap {
+		addStack(v.MallocStackId)
+		addStack(v.FreeStackId)
+	}
+	for _, op := range stats.MOList {
+		addStack(op.StackId)
+	}
+	if len(w.stacks) == 0 {
+		return nil
+	}
+	frames := globalStackTable.framesFrom(w.writtenFrames)
+	err := w.writeRecord(&trackRecord{Frames: frames, Stacks: w.stacks})
+	w.writtenFrames += len(frames)
+	w.stacks = nil
+	return err
+}
+
+func (w *trackWriter) close() error {
+	err := w.writer.Flush()
+	if err != nil {
+		_ = w.file.Close()
+		return fmt.Errorf("write track file error: %v", err)
+	}
+	return w.file.Close()
+}
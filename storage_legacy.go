@@ -0,0 +1,161 @@
+package main
+
+// Before version 3 every stat and op carried its full stack, these types
+// decode such files and convert them to stack table ids.
+
+// legacyStorageData is the version 0 track format.
+type legacyStorageData struct {
+	MSMap map[uint32]*legacyMallocStat
+	FSMap map[uint32]*legacyFreeStat
+	MOMap map[uintptr]*legacyMallocOp
+	MMMap map[uint32]*legacyMismatchStat
+}
+
+type legacyMallocStat struct {
+	Kind  AllocKind
+	Count int32
+	Byte  int64
+	Stack []string
+}
+
+type legacyFreeStat struct {
+	Kind  FreeKind
+	Count int32
+	Stack []string
+}
+
+type legacyMismatchStat struct {
+	Count       int32
+	Byte        int64
+	MallocKind  AllocKind
+	FreeKind    FreeKind
+	MallocStack []string
+	FreeStack   []string
+}
+
+type legacyMallocOp struct {
+	Seq     uint64
+	Time    int64
+	Tid     int32
+	Kind    AllocKind
+	Byte    int64
+	Addr    uintptr
+	OldAddr uintptr
+	Stack   []string
+}
+
+type legacyFreeOp struct {
+	Seq   uint64
+	Time  int64
+	Tid   int32
+	Kind  FreeKind
+	Addr  uintptr
+	Stack []string
+}
+
+type legacyTraceEvent struct {
+	Malloc *legacyMallocOp
+	Free   *legacyFreeOp
+}
+
+type legacyTrackStack struct {
+	Id     uint32
+	Frames []string
+}
+
+type legacyTrackStats struct {
+	Time   int64
+	MSMap  map[uint32]*legacyMallocStat
+	FSMap  map[uint32]*legacyFreeStat
+	MOList []*legacyMallocOp
+	MMMap  map[uint32]*legacyMismatchStat
+}
+
+// legacyTrackRecord is the frame payload of versions 1 and 2, version 1
+// wrote full events and version 2 the timeline with its stacks.
+type legacyTrackRecord struct {
+	Header   *trackHeader
+	Events   []*legacyTraceEvent
+	Stacks   []legacyTrackStack
+	Timeline []trackEvent
+	Stats    *legacyTrackStats
+}
+
+func (d *legacyStorageData) trackStats() *trackStats {
+	stats := &legacyTrackStats{
+		MSMap: d.MSMap,
+		FSMap: d.FSMap,
+		MMMap: d.MMMap,
+	}
+	for _, op := range d.MOMap {
+		stats.MOList = append(stats.MOList, op)
+	}
+	return stats.trackStats()
+}
+
+func (s *legacyTrackStats) trackStats() *trackStats {
+	stats := &trackStats{
+		Time:  s.Time,
+		MSMap: make(map[uint32]*MallocStat),
+		FSMap: make(map[uint32]*FreeStat),
+		MMMap: make(map[uint64]*MismatchStat),
+	}
+	for _, v := range s.MSMap {
+		id := internStack(v.Stack)
+		stats.MSMap[id] = &MallocStat{Kind: v.Kind, Count: int64(v.Count), Byte: v.Byte, StackId: id}
+	}
+	for _, v := range s.FSMap {
+		id := internStack(v.Stack)
+		stats.FSMap[id] = &FreeStat{Kind: v.Kind, Count: int64(v.Count), StackId: id}
+	}
+	for _, v := range s.MMMap {
+		mallocId := internStack(v.MallocStack)
+		freeId := internStack(v.FreeStack)
+		stats.MMMap[mismatchKey(mallocId, freeId)] = &MismatchStat{
+			Count:         int64(v.Count),
+			Byte:          v.Byte,
+			MallocKind:    v.MallocKind,
+			FreeKind:      v.FreeKind,
+			MallocStackId: mallocId,
+			FreeStackId:   freeId,
+		}
+	}
+	for _, op := range s.MOList {
+		stats.MOList = append(stats.MOList, op.mallocOp())
+	}
+	return stats
+}
+
+func (op *legacyMallocOp) mallocOp() *MallocOp {
+	return &MallocOp{
+		Seq:     op.Seq,
+		Time:    op.Time,
+		Tid:     op.Tid,
+		Kind:    op.Kind,
+		Byte:    op.Byte,
+		Addr:    op.Addr,
+		OldAddr: op.OldAddr,
+		StackId: internStack(op.Stack),
+	}
+}
+
+func (op *legacyFreeOp) freeOp() *FreeOp {
+	return &FreeOp{
+		Seq:     op.Seq,
+		Time:    op.Time,
+		Tid:     op.Tid,
+		Kind:    op.Kind,
+		Addr:    op.Addr,
+		StackId: internStack(op.Stack),
+	}
+}
+
+func (e *legacyTraceEvent) traceEvent() *TraceEvent {
+	if e.Malloc != nil {
+		return &TraceEvent{Malloc: e.Malloc.mallocOp()}
+	}
+	if e.Free != nil {
+		return &TraceEvent{Free: e.Free.freeOp()}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// testdata/pre_stack_table.track is a version 3 file, its stack ids are
+// the CRC32 of the frames: alloc_a 590501002, alloc_b 2626533653 and
+// release 116795121. Two allocations are written in the first chunk, a
+// release and an allocation in the second, then the stats.
+func TestLoadPreStackTableTrack(t *testing.T) {
+	t.Cleanup(resetMemStat)
+	if err := Load(filepath.Join("testdata", "pre_stack_table.track")); err != nil {
+		t.Fatal(err)
+	}
+	if loadTrackHeader.Version != 3 {
+		t.Errorf("loaded version %d, want 3", loadTrackHeader.Version)
+	}
+	for _, id := range []uint32{590501002, 2626533653, 116795121} {
+		if _, ok := mallocStatMap[id]; ok {
+			t.Errorf("malloc stat keyed by file stack id %d", id)
+		}
+		if _, ok := freeStatMap[id]; ok {
+			t.Errorf("free stat keyed by file stack id %d", id)
+		}
+	}
+
+	allocA := internStack(stackAllocA)
+	allocB := internStack(stackAllocB)
+	release := internStack(stackRelease)
+	checkMallocStat(t, stackAllocA, AllocMalloc, 2, 48)
+	checkMallocStat(t, stackAllocB, AllocMalloc, 1, 8)
+	if s := freeStatMap[release]; s == nil || s.Count != 1 || s.StackId != release {
+		t.Errorf("free stat %+v, want 1 release of stack %d", s, release)
+	}
+	checkRemain(t, map[opKey]uint64{{Addr: 0x2000}: 2, {Addr: 0x3000}: 4})
+	if m := remainMallocOpMap[opKey{Addr: 0x3000}]; m != nil && m.StackId != allocA {
+		t.Errorf("block 0x3000 of stack %d, want %d", m.StackId, allocA)
+	}
+
+	wantStacks := []uint32{allocA, allocB, release, allocA}
+	if len(trackTimeline) != len(wantStacks) {
+		t.Fatalf("loaded %d events, want %d", len(trackTimeline), len(wantStacks))
+	}
+	for i, e := range trackTimeline {
+		if e.StackId != wantStacks[i] {
+			t.Errorf("event %d of stack %d, want %d", e.Seq, e.StackId, wantStacks[i])
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testChunkEvents = 3
+
+// writeTestTrack records three chunks of allocations on stackAllocA and
+// leaves the file as a killed recorder would, without its stats. It returns
+// the path and the file size after each chunk.
+func writeTestTrack(t *testing.T) (string, []int64) {
+	t.Helper()
+	resetMemStat()
+	t.Cleanup(resetMemStat)
+	outPath := RecordOutPath
+	RecordOutPath = filepath.Join(t.TempDir(), "record.track")
+	t.Cleanup(func() { RecordOutPath = outPath })
+
+	path, err := StartSave("stap", "/usr/bin/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stackId := internStack(stackAllocA)
+	var sizes []int64
+	for chunk := 0; chunk < 3; chunk++ {
+		for i := 0; i < testChunkEvents; i++ {
+			n := uint64(chunk*testChunkEvents + i + 1)
+			SaveTraceEvent(&TraceEvent{Malloc: &MallocOp{Seq: n, Time: int64(n) * 1000, Pid: 100, Tid: 100,
+				Kind: AllocMalloc, Byte: 16, Addr: uintptr(0x1000 * n), StackId: stackId}, Comm: "app"})
+		}
+		FlushSave()
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, info.Size())
+	}
+	_ = saveTrack.file.Close()
+	saveTrack = nil
+	return path, sizes
+}
+
+func checkLoadedChunks(t *testing.T, path string, chunks int) {
+	t.Helper()
+	if err := Load(path); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	events := chunks * testChunkEvents
+	if len(trackTimeline) != events {
+		t.Errorf("loaded %d events, want %d", len(trackTimeline), events)
+	}
+	checkMallocStat(t, stackAllocA, AllocMalloc, int64(events), int64(events)*16)
+	if len(remainMallocOpMap) != events {
+		t.Errorf("remain %d blocks, want %d", len(remainMallocOpMap), events)
+	}
+	if loadTrackHeader.Version != trackVersion || loadTrackHeader.Exe != "/usr/bin/app" {
+		t.Errorf("loaded header %+v", loadTrackHeader)
+	}
+	if name := threadNameMap[100]; name != "app" {
+		t.Errorf("thread 100 named %q, want app", name)
+	}
+}
+
+func TestLoadTrack(t *testing.T) {
+	path, _ := writeTestTrack(t)
+	checkLoadedChunks(t, path, 3)
+}
+
+// A file cut anywhere in its last frame, or whose last frame is damaged,
+// loads every complete chunk before it.
+func TestLoadTruncatedTrack(t *testing.T) {
+	path, sizes := writeTestTrack(t)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastFrame := sizes[1]
+	payloadLen := sizes[2] - lastFrame - 8
+
+	tests := []struct {
+		name   string
+		length int64
+	}{
+		{"mid length", lastFrame + 2},
+		{"mid crc", lastFrame + 6},
+		{"after head", lastFrame + 8},
+		{"mid frame", lastFrame + 8 + payloadLen/2},
+		{"last byte", sizes[2] - 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cut := filepath.Join(t.TempDir(), "cut.track")
+			if err := os.WriteFile(cut, content[:tt.length], 0666); err != nil {
+				t.Fatal(err)
+			}
+			checkLoadedChunks(t, cut, 2)
+		})
+	}
+
+	t.Run("bad crc", func(t *testing.T) {
+		damaged := append([]byte{}, content...)
+		damaged[lastFrame+8+payloadLen/2] ^= 0xff
+		bad := filepath.Join(t.TempDir(), "bad.track")
+		if err := os.WriteFile(bad, damaged, 0666); err != nil {
+			t.Fatal(err)
+		}
+		checkLoadedChunks(t, bad, 2)
+	})
+}
+
+// testdata/baseline.track was saved by the first version of the recorder,
+// a single gob encoded storageData whose stats are keyed by stack hash.
+func TestLoadBaselineTrack(t *testing.T) {
+	t.Cleanup(resetMemStat)
+	if err := Load(filepath.Join("testdata", "baseline.track")); err != nil {
+		t.Fatal(err)
+	}
+	if loadTrackHeader.Version != 0 {
+		t.Errorf("loaded version %d, want 0", loadTrackHeader.Version)
+	}
+	if len(mallocStatMap) != 2 {
+		t.Errorf("%d malloc stacks, want 2", len(mallocStatMap))
+	}
+	checkMallocStat(t, stackAllocA, AllocMalloc, 2, 48)
+	checkMallocStat(t, stackAllocB, AllocMalloc, 1, 8)
+	if s := freeStatMap[internStack(stackRelease)]; s == nil || s.Count != 1 || s.Kind != FreeFree {
+		t.Errorf("free stat %+v, want 1 free", s)
+	}
+	checkRemain(t, map[opKey]uint64{{Addr: 0x2000}: 0, {Addr: 0x3000}: 0})
+	if m := remainMallocOpMap[opKey{Addr: 0x2000}]; m != nil && (m.Byte != 32 || m.StackId != internStack(stackAllocA)) {
+		t.Errorf("block 0x2000 is %d bytes of stack %d, want 32 bytes of stack %d", m.Byte, m.StackId, internStack(stackAllocA))
+	}
+	if len(trackSnapshots) != 1 {
+		t.Errorf("%d snapshots, want 1", len(trackSnapshots))
+	}
+}
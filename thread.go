@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ThreadStacks is the number of stacks listed in a thread detail.
+const ThreadStacks = 10
+
+type threadStack struct {
+	Tid     int32
+	StackId uint32
+}
+
+type ThreadMallocStat struct {
+	Tid     int32
+	Count   int64
+	Byte    int64
+	StackId uint32
+}
+
+type ThreadFreeStat struct {
+	Tid   int32
+	Count int64
+}
+
+// threadNameMap keeps the last name reported for each thread, it is not
+// a statistic and survives the replays of the timeline.
+var threadNameMap = make(map[int32]string)
+
+func addThreadMallocStat(m *MallocOp) {
+	key := threadStack{m.Tid, m.StackId}
+	if s, ok := threadMallocStatMap[key]; ok {
+		s.Count += m.weight()
+		s.Byte += m.weightedByte()
+		return
+	}
+	threadMallocStatMap[key] = &ThreadMallocStat{Tid: m.Tid, Count: m.weight(), Byte: m.weightedByte(), StackId: m.StackId}
+}
+
+func addThreadFreeStat(f *FreeOp, weight int64) {
+	if s, ok := threadFreeStatMap[f.Tid]; ok {
+		s.Count += weight
+		return
+	}
+	threadFreeStatMap[f.Tid] = &ThreadFreeStat{Tid: f.Tid, Count: weight}
+}
+
+func threadTitle(tid int32) string {
+	if name, ok := threadNameMap[tid]; ok {
+		return fmt.Sprintf("%s (%d)", name, tid)
+	}
+	return fmt.Sprintf("thread (%d)", tid)
+}
+
+// threadRows groups the allocations by thread, with the stacks the thread
+// allocates the most bytes from.
+func threadRows() []mainRow {
+	totals := make(map[int32]*statValues)
+	stacks := make(map[int32][]*ThreadMallocStat)
+	get := func(tid int32) *statValues {
+		v, ok := totals[tid]
+		if !ok {
+			v = &statValues{}
+			totals[tid] = v
+		}
+		return v
+	}
+	for _, s := range threadMallocStatMap {
+		v := get(s.Tid)
+		v.AllocCount += s.Count
+		v.AllocBytes += s.Byte
+		stacks[s.Tid] = append(stacks[s.Tid], s)
+	}
+	for _, op := range remainMallocOpMap {
+		v := get(op.Tid)
+		v.LiveCount += op.weight()
+		v.LiveBytes += op.weightedByte()
+	}
+
+	tids := make([]int32, 0, len(totals))
+	for tid := range totals {
+		tids = append(tids, tid)
+	}
+	sort.Slice(tids, func(i, j int) bool {
+		if totals[tids[i]].AllocBytes != totals[tids[j]].AllocBytes {
+			return totals[tids[i]].AllocBytes > totals[tids[j]].AllocBytes
+		}
+		return tids[i] < tids[j]
+	})
+
+	var rows []mainRow
+	for _, tid := range tids {
+		v := totals[tid]
+		var freeCount int64
+		if s, ok := threadFreeStatMap[tid]; ok {
+			freeCount = s.Count
+		}
+		detail := []string{
+			fmt.Sprintf("alloc: %d times %d bytes, free: %d times", v.AllocCount, v.AllocBytes, freeCount),
+			fmt.Sprintf("live: %d blocks %d bytes", v.LiveCount, v.LiveBytes),
+			"",
+			"Top stacks:",
+		}
+		list := stacks[tid]
+		sort.Slice(list, func(i, j int) bool {
+			if list[i].Byte != list[j].Byte {
+				return list[i].Byte > list[j].Byte
+			}
+			return list[i].StackId < list[j].StackId
+		})
+		for index, s := range list {
+			if index >= ThreadStacks {
+				break
+			}
+			title := "unknown"
+			if stack := getStack(s.StackId); len(stack) > 0 {
+				title, _ = translateStackString(stack[0])
+			}
+			detail = append(detail, fmt.Sprintf("  %d times %d bytes %s", s.Count, s.Byte, title))
+		}
+		rows = append(rows, mainRow{
+			Title:  threadTitle(tid),
+			Value:  fmt.Sprintf("%d", v.AllocBytes),
+			Detail: detail,
+		})
+	}
+	return rows
+}
+
+// filterRecordEvent keeps the events of the --tid threads. The probes
+// drop the allocations of the other threads already, but not their
+// releases, the ones of blocks of the --tid threads are kept, else the
+// blocks would look leaked.
+func filterRecordEvent(e *TraceEvent) *TraceEvent {
+	if len(RecordTids) == 0 {
+		return e
+	}
+	for _, tid := range RecordTids {
+		if e.Tid() == tid {
+			return e
+		}
+	}
+	if f := e.Free; f != nil {
+		if _, ok := remainMallocOpMap[opKey{f.Source, f.Pid, f.Addr}]; ok {
+			return e
+		}
+		return nil
+	}
+	m := e.Malloc
+	if m.Kind == AllocRealloc && m.OldAddr != 0 && (m.Addr != 0 || m.Byte == 0) {
+		if _, ok := remainMallocOpMap[opKey{m.Source, m.Pid, m.OldAddr}]; ok {
+			return &TraceEvent{Free: &FreeOp{
+				Seq:     m.Seq,
+				Time:    m.Time,
+				Pid:     m.Pid,
+				Tid:     m.Tid,
+				Kind:    FreeRealloc,
+				Addr:    m.OldAddr,
+				StackId: m.StackId,
+				Source:  m.Source,
+			}, Comm: e.Comm}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// trackEvent is the compact form of a TraceEvent kept in the track file
+// and in memory for the report, the stack is referred by its id.
+type trackEvent struct {
+	Seq     uint64
+	Time    int64
+	Pid     int32
+	Tid     int32
+	Free    bool
+	Kind    uint8
+	Addr    uintptr
+	OldAddr uintptr
+	Byte    int64
+	StackId uint32
+	Weight  int64
+}
+
+var trackTimeline []trackEvent
+
+// timelineFrom and timelineTo bound the events the statistics were
+// computed from, zero means the whole timeline.
+var timelineFrom int64
+var timelineTo int64
+
+// timelinePid is the process the statistics were computed from, zero
+// means all the recorded processes.
+var timelinePid int32
+
+func resetTimeline() {
+	trackTimeline = nil
+	timelineFrom = 0
+	timelineTo = 0
+	timelinePid = 0
+}
+
+func newTrackEvent(e *TraceEvent) trackEvent {
+	if e.Malloc != nil {
+		m := e.Malloc
+		return trackEvent{
+			Seq:     m.Seq,
+			Time:    m.Time,
+			Pid:     m.Pid,
+			Tid:     m.Tid,
+			Kind:    uint8(m.Kind),
+			Addr:    m.Addr,
+			OldAddr: m.OldAddr,
+			Byte:    m.Byte,
+			StackId: m.StackId,
+			Weight:  m.Weight,
+		}
+	}
+	f := e.Free
+	return trackEvent{
+		Seq:     f.Seq,
+		Time:    f.Time,
+		Pid:     f.Pid,
+		Tid:     f.Tid,
+		Free:    true,
+		Kind:    uint8(f.Kind),
+		Addr:    f.Addr,
+		StackId: f.StackId,
+	}
+}
+
+func (te *trackEvent) traceEvent() *TraceEvent {
+	if te.Free {
+		return &TraceEvent{Free: &FreeOp{
+			Seq:     te.Seq,
+			Time:    te.Time,
+			Pid:     te.Pid,
+			Tid:     te.Tid,
+			Kind:    FreeKind(te.Kind),
+			Addr:    te.Addr,
+			StackId: te.StackId,
+		}}
+	}
+	return &TraceEvent{Malloc: &MallocOp{
+		Seq:     te.Seq,
+		Time:    te.Time,
+		Pid:     te.Pid,
+		Tid:     te.Tid,
+		Kind:    AllocKind(te.Kind),
+		Byte:    te.Byte,
+		Addr:    te.Addr,
+		OldAddr: te.OldAddr,
+		StackId: te.StackId,
+		Weight:  te.Weight,
+	}}
+}
+
+func applyTrackEvent(te trackEvent) {
+	applyTraceEvent(te.traceEvent())
+}
+
+// timelineStartTime is the record start, or the first timed event for
+// files without header.
+func timelineStartTime() int64 {
+	if loadTrackHeader.StartTime > 0 {
+		return loadTrackHeader.StartTime
+	}
+	for _, te := range trackTimeline {
+		if te.Time != 0 {
+			return te.Time
+		}
+	}
+	return 0
+}
+
+// timelineTimed tells whether the events have a time.
+func timelineTimed() bool {
+	for _, te := range trackTimeline {
+		if te.Time != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func timelineEndTime() int64 {
+	for i := len(trackTimeline) - 1; i >= 0; i-- {
+		if trackTimeline[i].Time != 0 {
+			return trackTimeline[i].Time
+		}
+	}
+	return timelineStartTime()
+}
+
+// ReplayTimeRange recomputes the statistics from the events of the process
+// pid, or of all the processes if pid is 0, between from and to, both
+// relative to the record start, to <= 0 means the record end. Allocations
+// made in the window and not freed before its end are the ones still
+// allocated. The events without time, as imported from old stap logs, are
+// only replayed without range.
+func ReplayTimeRange(from time.Duration, to time.Duration, pid int32) error {
+	if len(trackTimeline) == 0 {
+		return errors.New("no event timeline in this track file")
+	}
+	ranged := from > 0 || to > 0
+	if ranged && !timelineTimed() {
+		return errors.New("the events of this track file have no time, no time range applies")
+	}
+	start := timelineStartTime()
+	fromTime := start + int64(from)
+	toTime := timelineEndTime()
+	if to > 0 {
+		toTime = start + int64(to)
+	}
+	if ranged && fromTime > toTime {
+		return fmt.Errorf("time range from %v is after to %v", from, to)
+	}
+
+	if pid != 0 && !timelineHasPid(pid) {
+		return fmt.Errorf("process %d not found in the track file", pid)
+	}
+
+	resetMemStat()
+	timelineFrom = fromTime
+	timelineTo = toTime
+	timelinePid = pid
+	count := 0
+	for _, te := range trackTimeline {
+		if pid != 0 && te.Pid != pid {
+			continue
+		}
+		if te.Time == 0 {
+			if ranged {
+				continue
+			}
+		} else if te.Time < fromTime || te.Time > toTime {
+			continue
+		}
+		applyTrackEvent(te)
+		count++
+	}
+	PrintVerboseInfo("replay %d events in [%v, %v]", count, time.Duration(fromTime-start), time.Duration(toTime-start))
+	return nil
+}
+
+// timelineRange returns the time range of the reported events relative to
+// the record start, as taken by ReplayTimeRange.
+func timelineRange() (time.Duration, time.Duration) {
+	var from, to time.Duration
+	start := timelineStartTime()
+	if timelineFrom > 0 {
+		from = time.Duration(timelineFrom - start)
+	}
+	if timelineTo > 0 {
+		to = time.Duration(timelineTo - start)
+	}
+	return from, to
+}
+
+// timelinePids returns the recorded processes in pid order, the events of
+// files recorded before the pids were tagged have none.
+func timelinePids() []int32 {
+	seen := make(map[int32]bool)
+	var pids []int32
+	for _, te := range trackTimeline {
+		if te.Pid != 0 && !seen[te.Pid] {
+			seen[te.Pid] = true
+			pids = append(pids, te.Pid)
+		}
+	}
+	sort.Slice(pids, func(i, j int) bool { return pids[i] < pids[j] })
+	return pids
+}
+
+func timelineHasPid(pid int32) bool {
+	for _, te := range trackTimeline {
+		if te.Pid == pid {
+			return true
+		}
+	}
+	return false
+}
+
+func pidTitle(pid int32) string {
+	if pid == 0 {
+		return "pid: all"
+	}
+	return fmt.Sprintf("pid: %d", pid)
+}
+
+// timelineWindow returns the time range of the reported events.
+func timelineWindow() (int64, int64) {
+	from := timelineStartTime()
+	to := timelineEndTime()
+	if timelineFrom > 0 {
+		from = timelineFrom
+	}
+	if timelineTo > 0 {
+		to = timelineTo
+	}
+	return from, to
+}
+
+// growthSeries is the live heap over the reported time window, split in
+// buckets of equal duration holding the peak value seen in the bucket.
+type growthSeries struct {
+	From       int64
+	To         int64
+	Bytes      []int64
+	Count      []int64
+	StackBytes []int64
+}
+
+// liveBlock holds the weighted count and bytes of a live block.
+type liveBlock struct {
+	Count   int64
+	Byte    int64
+	StackId uint32
+}
+
+// computeGrowthSeries replays the timeline to follow the live bytes and
+// blocks, and the live bytes allocated by the stack unless its id is 0.
+// The events before the window are replayed as well, for the blocks
+// still live when it starts, only the buckets of the window are drawn.
+func computeGrowthSeries(buckets int, stackId uint32) (*growthSeries, error) {
+	if len(trackTimeline) == 0 {
+		return nil, errors.New("no event timeline in this track file")
+	}
+	if !timelineTimed() {
+		return nil, errors.New("the events of this track file have no time")
+	}
+	if buckets <= 0 {
+		return nil, errors.New("no room for the chart")
+	}
+	from, to := timelineWindow()
+	series := &growthSeries{
+		From:       from,
+		To:         to,
+		Bytes:      make([]int64, buckets),
+		Count:      make([]int64, buckets),
+		StackBytes: make([]int64, buckets),
+	}
+
+	live := make(map[opKey]liveBlock)
+	var bytes, count, stackBytes int64
+	release := func(addr opKey) {
+		if block, ok := live[addr]; ok {
+			bytes -= block.Byte
+			count -= block.Count
+			if stackId != 0 && block.StackId == stackId {
+				stackBytes -= block.Byte
+			}
+			delete(live, addr)
+		}
+	}
+	last := -1
+	for _, te := range trackTimeline {
+		if te.Time > to || (timelinePid != 0 && te.Pid != timelinePid) {
+			continue
+		}
+		inWindow := te.Time >= from
+		index := buckets - 1
+		if inWindow && to > from {
+			index = int((te.Time - from) * int64(buckets-1) / (to - from))
+		}
+		// a bucket starts with the values left by the previous events
+		for inWindow && last < index {
+			last++
+			series.Bytes[last] = bytes
+			series.Count[last] = count
+			series.StackBytes[last] = stackBytes
+		}
+
+		if te.Free {
+			release(opKey{Pid: te.Pid, Addr: te.Addr})
+		} else {
+			// same rules as addMallocOp for realloc and failed allocations
+			if AllocKind(te.Kind) == AllocRealloc && te.OldAddr != 0 && (te.Addr != 0 || te.Byte == 0) {
+				release(opKey{Pid: te.Pid, Addr: te.OldAddr})
+			}
+			if te.Addr != 0 {
+				key := opKey{Pid: te.Pid, Addr: te.Addr}
+				release(key)
+				weight := te.Weight
+				if weight < 1 {
+					weight = 1
+				}
+				block := liveBlock{Count: weight, Byte: te.Byte * weight, StackId: te.StackId}
+				live[key] = block
+				bytes += block.Byte
+				count += block.Count
+				if stackId != 0 && te.StackId == stackId {
+					stackBytes += block.Byte
+				}
+			}
+		}
+
+		if !inWindow {
+			continue
+		}
+		if bytes > series.Bytes[index] {
+			series.Bytes[index] = bytes
+		}
+		if count > series.Count[index] {
+			series.Count[index] = count
+		}
+		if stackBytes > series.StackBytes[index] {
+			series.StackBytes[index] = stackBytes
+		}
+	}
+	for last < buckets-1 {
+		last++
+		series.Bytes[last] = bytes
+		series.Count[last] = count
+		series.StackBytes[last] = stackBytes
+	}
+	return series, nil
+}
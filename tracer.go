@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// Tracer probes the memory operations of processes and streams them as
+// TraceEvent, backends are selected by name with the record --backend flag.
+type Tracer interface {
+	CheckDependency() error
+	Start(target traceTarget, evc chan *TraceEvent, ec chan error)
+	// Attach adds processes to a started target with Watch set.
+	Attach(pids []int32) error
+	Stop()
+}
+
+// traceTarget are the processes to probe, the libraries they map make
+// a probe set. With FollowChildren the processes they fork during
+// the record are probed as well, with Watch more may be attached.
+type traceTarget struct {
+	Pids           []int32
+	FollowChildren bool
+	Watch          bool
+}
+
+// single tells whether the target is one process, which the tracers can
+// filter on their own without keeping a set of pids.
+func (t traceTarget) single() bool {
+	return len(t.Pids) == 1 && !t.FollowChildren && !t.Watch
+}
+
+var libcRegexp = regexp.MustCompile(`^libc(\.so|-[0-9.]+\.so)`)
+var libStdCppRegexp = regexp.MustCompile(`^libstdc\+\+\.so`)
+
+// fileId tells files apart whatever the path they are reached by, the
+// same library has another path in each container.
+type fileId struct {
+	Dev uint64
+	Ino uint64
+}
+
+// probeLib is a library to probe. The paths are the ones of our mount
+// namespace, the binaries of a container are reached through
+// /proc/pid/root.
+type probeLib struct {
+	Id   fileId
+	Path string
+}
+
+// processBinaries are the binaries mapped by a target, LibStdCpp has no
+// path when not mapped.
+type processBinaries struct {
+	Exe       string
+	LibC      probeLib
+	LibStdCpp probeLib
+}
+
+// probeSet are the libraries mapped by a group of targets, each one is
+// probed once whatever the number of targets mapping it.
+type probeSet struct {
+	LibCs      []probeLib
+	LibStdCpps []probeLib
+	Exes       []string
+	Pids       []int32
+}
+
+// newProbeSet resolves the binaries of the processes.
+func newProbeSet(pids []int32) (*probeSet, error) {
+	s := &probeSet{}
+	for _, pid := range pids {
+		b, err := resolveProcessBinaries(pid)
+		if err != nil {
+			return nil, err
+		}
+		s.add(pid, b)
+	}
+	return s, nil
+}
+
+func (s *probeSet) add(pid int32, b processBinaries) {
+	PrintDebugInfo("probe process(%d) exe(%s) libc(%s) libstdc++(%s)", pid, b.Exe, b.LibC.Path, b.LibStdCpp.Path)
+	s.Pids = append(s.Pids, pid)
+	if !hasProbeLib(s.LibCs, b.LibC) {
+		s.LibCs = append(s.LibCs, b.LibC)
+	}
+	if len(b.LibStdCpp.Path) > 0 && !hasProbeLib(s.LibStdCpps, b.LibStdCpp) {
+		s.LibStdCpps = append(s.LibStdCpps, b.LibStdCpp)
+	}
+	for _, exe := range s.Exes {
+		if exe == b.Exe {
+			return
+		}
+	}
+	s.Exes = append(s.Exes, b.Exe)
+}
+
+// covers tells whether the libraries of the binaries are all probed.
+func (s *probeSet) covers(b processBinaries) bool {
+	return hasProbeLib(s.LibCs, b.LibC) && (len(b.LibStdCpp.Path) == 0 || hasProbeLib(s.LibStdCpps, b.LibStdCpp))
+}
+
+func hasProbeLib(libs []probeLib, lib probeLib) bool {
+	for _, l := range libs {
+		if l.Id == lib.Id {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveProcessBinaries reads the libraries from the mappings of the
+// process rather than from ldd on our side, which may see other ones.
+func resolveProcessBinaries(pid int32) (processBinaries, error) {
+	var b processBinaries
+	exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	if err != nil {
+		return b, fmt.Errorf("get exec file path error! pid(%d)\n %w", pid, err)
+	}
+	b.Exe = processHostPath(pid, strings.TrimSuffix(exe, " (deleted)"))
+	f, err := os.Open(fmt.Sprintf("/proc/%d/maps", pid))
+	if err != nil {
+		return b, fmt.Errorf("read process(%d) maps error: %w", pid, err)
+	}
+	defer f.Close()
+	var libC, libStdCpp string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || !strings.HasPrefix(fields[5], "/") {
+			continue
+		}
+		name := filepath.Base(fields[5])
+		if len(libC) == 0 && libcRegexp.MatchString(name) {
+			libC = fields[5]
+		} else if len(libStdCpp) == 0 && libStdCppRegexp.MatchString(name) {
+			libStdCpp = fields[5]
+		}
+	}
+	if len(libC) == 0 {
+		return b, fmt.Errorf("get libc path error! process(%d) maps no libc", pid)
+	}
+	b.LibC, err = newProbeLib(processHostPath(pid, libC))
+	if err != nil {
+		return b, err
+	}
+	if len(libStdCpp) > 0 {
+		b.LibStdCpp, err = newProbeLib(processHostPath(pid, libStdCpp))
+	}
+	return b, err
+}
+
+// processHostPath returns the path of a file seen by the process as path,
+// through its root when it runs in another mount namespace.
+func processHostPath(pid int32, path string) string {
+	root := fmt.Sprintf("/proc/%d/root", pid)
+	rootInfo, err := os.Stat(root)
+	if err != nil {
+		return path
+	}
+	ourInfo, err := os.Stat("/")
+	if err == nil && os.SameFile(rootInfo, ourInfo) {
+		return path
+	}
+	return root + path
+}
+
+func newProbeLib(path string) (probeLib, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return probeLib{}, fmt.Errorf("stat %s error: %w", path, err)
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return probeLib{}, fmt.Errorf("stat %s error: no inode", path)
+	}
+	return probeLib{Id: fileId{Dev: uint64(st.Dev), Ino: st.Ino}, Path: path}, nil
+}
+
+var tracerCreatorMap = map[string]func() Tracer{
+	"stap":     newStapTracer,
+	"bpftrace": newBpftraceTracer,
+}
+
+func NewTracer(backend string) (Tracer, error) {
+	creator, ok := tracerCreatorMap[backend]
+	if !ok {
+		return nil, fmt.Errorf("unknown backend: %s (support: %s)", backend, strings.Join(TracerBackendNames(), ", "))
+	}
+	return creator(), nil
+}
+
+func TracerBackendNames() []string {
+	var names []string
+	for name := range tracerCreatorMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -7,7 +7,9 @@ import (
 	"github.com/shirou/gopsutil/process"
 	"os/exec"
 	"os/user"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -48,6 +50,57 @@ func IsProcessRunning(pid int32) bool {
 	return false
 }
 
+// FindProcessPids resolves the record targets, a pid or a process name
+// standing for all the processes of that name.
+func FindProcessPids(targets []string) ([]int32, error) {
+	var pids []int32
+	seen := make(map[int32]bool)
+	add := func(pid int32) {
+		if !seen[pid] {
+			seen[pid] = true
+			pids = append(pids, pid)
+		}
+	}
+	for _, target := range targets {
+		if pid, err := strconv.ParseInt(target, 10, 32); err == nil {
+			add(int32(pid))
+			continue
+		}
+		matched := GetProcessPidsByName(target)
+		if len(matched) == 0 {
+			return nil, fmt.Errorf("no process named %s", target)
+		}
+		for _, pid := range matched {
+			add(pid)
+		}
+	}
+	if len(pids) == 0 {
+		return nil, errors.New("no target process")
+	}
+	return pids, nil
+}
+
+func GetProcessPidsByName(name string) []int32 {
+	var pids []int32
+	processes, _ := process.Processes()
+	for _, p := range processes {
+		if IsProcessNamed(p, name) {
+			pids = append(pids, p.Pid)
+		}
+	}
+	return pids
+}
+
+// IsProcessNamed matches the process name, which the kernel cuts to 15
+// characters, or else the base name of the executable.
+func IsProcessNamed(p *process.Process, name string) bool {
+	if n, err := p.Name(); err == nil && n == name {
+		return true
+	}
+	exe, err := p.Exe()
+	return err == nil && filepath.Base(exe) == name
+}
+
 func GetProcessExecutableFilePath(pid int32) (string, error) {
 	out, err := RunShellCommand(fmt.Sprintf("ls -l /proc/%d", pid))
 	if err != nil {
@@ -62,20 +115,28 @@ func GetProcessExecutableFilePath(pid int32) (string, error) {
 	}
 }
 
-func GetDynamicDependencyPath(execPath string, depName string) (string, error) {
-	out, err := RunShellCommand(fmt.Sprintf("ldd %s", execPath))
+func GetDynamicSymbolAddressMap(libPath string) (map[string]uint64, error) {
+	// the paths are read from the mappings of the targets, which may run
+	// in a container, so no shell sees them
+	out, err := RunCommand("nm", "-D", "--defined-only", "--", libPath)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	regStr := fmt.Sprintf("/.+%s\\.so.+ ", depName)
-	PrintDebugInfo("regexp string : \"%s\"", regStr)
-	reg := regexp.MustCompile(regStr)
-	ret := reg.FindString(out)
-	if len(ret) > 0 {
-		return ret[:len(ret)-1], nil
-	} else {
-		return "", errors.New(fmt.Sprintf("find \"%s\" failed!", regStr))
+	symbolMap := make(map[string]uint64)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		addr, err := strconv.ParseUint(fields[0], 16, 64)
+		if err != nil {
+			continue
+		}
+		// strip symbol version, e.g. "malloc@@GLIBC_2.2.5"
+		name := strings.SplitN(fields[2], "@", 2)[0]
+		symbolMap[name] = addr
 	}
+	return symbolMap, nil
 }
 
 func RunShellCommand(cmd string) (string, error) {
@@ -84,23 +145,43 @@ func RunShellCommand(cmd string) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	printCommandOutput(out)
+	return string(out), nil
+}
+
+// RunCommand runs the program without a shell, for arguments read from
+// track files or processes.
+func RunCommand(name string, args ...string) (string, error) {
+	out, err := exec.Command(name, args...).Output()
+	PrintDebugInfo("run command: %s %q", name, args)
+	if err != nil {
+		return "", err
+	}
+	printCommandOutput(out)
+	return string(out), nil
+}
+
+func printCommandOutput(out []byte) {
 	if Debug {
 		color.Debug.Prompt("=========================================")
 		color.Debug.Prompt("run shell output:")
 		color.Comment.Print(string(out))
 		color.Debug.Prompt("=========================================")
 	}
-	return string(out), nil
 }
 
+// PrintVerboseInfo prints the message, or shows it in the live UI while it
+// owns the terminal.
 func PrintVerboseInfo(format string, a ...interface{}) {
-	if Verbose || Debug {
+	if (Verbose || Debug) && !setLiveStatus(format, a...) {
 		color.Info.Prompt(format, a...)
 	}
 }
 
+// PrintDebugInfo prints the message, dropped while the live UI owns the
+// terminal.
 func PrintDebugInfo(format string, a ...interface{}) {
-	if Debug {
+	if Debug && !liveUIRunning() {
 		color.Debug.Prompt(format, a...)
 	}
 }
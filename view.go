@@ -3,9 +3,12 @@ package main
 import (
 	"fmt"
 	"github.com/jroimartin/gocui"
+	"io"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 const (
@@ -16,33 +19,183 @@ const (
 	MenuWidth         = 30
 	MainWidth         = 60
 	MainFunctionWidth = MainWidth - 15
+	ChartAxisWidth    = 8
+
+	LiveRefreshInterval = time.Second
 )
 
 var menuSelectIndex int = 0
 var mainSelectIndex int = 0
 
-const (
-	MallocTopByte           = 0
-	MallocTopCount          = 1
-	MallocTopByteAfterFree  = 2
-	MallocTopCountAfterFree = 3
-)
+type menuItem struct {
+	Description string
+	ValueName   string
+	Rows        []mainRow
+}
+
+type mainRow struct {
+	Title   string
+	Value   string
+	Stack   []string
+	StackId uint32
+	Detail  []string
+	// Chart draws the heap growth, with the live bytes of StackId
+	// overlaid unless it is 0. The rows of a stack draw it as well when
+	// the track file has a timeline.
+	Chart bool
+}
 
-var MenuDescriptionSlice []string
+var menuItemSlice []menuItem
 
 var mallocTopByteSlice []MallocStat
 var mallocTopCountSlice []MallocStat
 var mallocTopByteAfterFreeSlice []MallocStat
 var mallocTopCountAfterFreeSlice []MallocStat
+var newTopByteSlice []MallocStat
+var newTopCountSlice []MallocStat
+var newArrayTopByteSlice []MallocStat
+var newArrayTopCountSlice []MallocStat
+var mismatchSlice []MismatchStat
+
+// sourceLiveStatMap is the live share of the sources by stack, built on
+// first use.
+var sourceLiveStatMap map[sourceStack]*SourceMallocStat
 
 var cppfiltCacheMap = make(map[string]string)
 
+// liveStartTime is set while the UI shows a record in progress.
+var liveStartTime time.Time
+
+// liveStatus holds the last verbose message printed while the live UI owns
+// the terminal, shown in the title of the main view on the next refresh.
+var liveStatus struct {
+	sync.Mutex
+	running bool
+	message string
+}
+
+// setLiveStatus keeps the message for the live UI and reports whether it
+// runs, the message is printed otherwise.
+func setLiveStatus(format string, a ...interface{}) bool {
+	liveStatus.Lock()
+	defer liveStatus.Unlock()
+	if liveStatus.running {
+		liveStatus.message = fmt.Sprintf(format, a...)
+	}
+	return liveStatus.running
+}
+
+func liveUIRunning() bool {
+	liveStatus.Lock()
+	defer liveStatus.Unlock()
+	return liveStatus.running
+}
+
+func takeLiveStatus() string {
+	liveStatus.Lock()
+	defer liveStatus.Unlock()
+	message := liveStatus.message
+	liveStatus.message = ""
+	return message
+}
+
+func setLiveRunning(running bool) {
+	liveStatus.Lock()
+	liveStatus.running = running
+	liveStatus.message = ""
+	liveStatus.Unlock()
+}
+
 var mainViewWindowMin int
 var mainViewWindowMax int
 
 func ShowReportUI() error {
 	prepareData()
+	prepareMenu()
+	if len(timelinePids()) < 2 {
+		return showMenuUI()
+	}
+	return runMenuUI(func(g *gocui.Gui) error {
+		return g.SetKeybinding("", 'p', gocui.ModNone, keySwitchPid)
+	})
+}
+
+// ShowLiveUI shows the statistics of the record in progress, refreshed
+// every LiveRefreshInterval, until done is closed or the user quits.
+func ShowLiveUI(done <-chan struct{}) error {
+	liveStartTime = time.Now()
+	refreshLiveData()
+	stop := make(chan struct{})
+	defer close(stop)
+	setLiveRunning(true)
+	defer setLiveRunning(false)
+	return runMenuUI(func(g *gocui.Gui) error {
+		err := g.SetKeybinding("", 's', gocui.ModNone, keySnapshot)
+		if err != nil {
+			return err
+		}
+		go func() {
+			ticker := time.NewTicker(LiveRefreshInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					g.Update(func(g *gocui.Gui) error {
+						refreshLiveData()
+						drawMenuView(g)
+						drawMainView(g)
+						drawDetailView(g)
+						if message := takeLiveStatus(); message != "" {
+							mainV, _ := g.View(Main)
+							mainV.Title = fmt.Sprintf("Main Window [%s]", message)
+						}
+						return nil
+					})
+				case <-done:
+					g.Update(func(g *gocui.Gui) error {
+						return gocui.ErrQuit
+					})
+					return
+				case <-stop:
+					return
+				}
+			}
+		}()
+		return nil
+	})
+}
+
+// refreshLiveData rebuilds the menu from the statistics collected so far,
+// keeping the selection in the new rows.
+func refreshLiveData() {
+	memStatMutex.Lock()
+	prepareData()
+	prepareMenu()
+	memStatMutex.Unlock()
+	clampSelection()
+}
+
+// clampSelection keeps the selection in the rows of a rebuilt menu.
+func clampSelection() {
+	if menuSelectIndex >= len(menuItemSlice) {
+		menuSelectIndex = len(menuItemSlice) - 1
+	}
+	if rows := getMainViewRows(); mainSelectIndex >= len(rows) {
+		mainSelectIndex = len(rows) - 1
+	}
+	if mainSelectIndex < 0 {
+		mainSelectIndex = 0
+	}
+}
 
+// showMenuUI runs the UI on the prepared menuItemSlice.
+func showMenuUI() error {
+	return runMenuUI(nil)
+}
+
+// runMenuUI runs the UI on the prepared menuItemSlice, start is called
+// once the views are drawn.
+func runMenuUI(start func(g *gocui.Gui) error) error {
 	g, err := gocui.NewGui(gocui.OutputNormal)
 	if err != nil {
 		return fmt.Errorf("new cui error: %w", err)
@@ -71,6 +224,13 @@ func ShowReportUI() error {
 	drawMainView(g)
 	drawDetailView(g)
 
+	if start != nil {
+		err = start(g)
+		if err != nil {
+			return fmt.Errorf("cui start error: %w", err)
+		}
+	}
+
 	err = g.MainLoop()
 	if err != nil && err != gocui.ErrQuit {
 		return fmt.Errorf("cui main loop error: %w", err)
@@ -79,12 +239,29 @@ func ShowReportUI() error {
 }
 
 func prepareData() {
+	sourceLiveStatMap = nil
+	mallocTopByteSlice = nil
+	mallocTopCountSlice = nil
+	mallocTopByteAfterFreeSlice = nil
+	mallocTopCountAfterFreeSlice = nil
+	newTopByteSlice = nil
+	newTopCountSlice = nil
+	newArrayTopByteSlice = nil
+	newArrayTopCountSlice = nil
+	mismatchSlice = nil
 	for _, v := range mallocStatMap {
-		if v.Byte >= ReportMinByte {
-			mallocTopByteSlice = append(mallocTopByteSlice, *v)
+		stat := *v
+		if reportSizeRange() {
+			stat = filterMallocStatBySize(stat)
+			if stat.Count == 0 {
+				continue
+			}
 		}
-		if v.Count >= ReportMinCount {
-			mallocTopCountSlice = append(mallocTopCountSlice, *v)
+		if stat.Byte >= ReportMinByte {
+			mallocTopByteSlice = append(mallocTopByteSlice, stat)
+		}
+		if stat.Count >= ReportMinCount {
+			mallocTopCountSlice = append(mallocTopCountSlice, stat)
 		}
 	}
 	sort.SliceStable(mallocTopByteSlice, func(i, j int) bool {
@@ -96,14 +273,18 @@ func prepareData() {
 
 	remainMallocStatMap := make(map[uint32]*MallocStat)
 	for _, v := range remainMallocOpMap {
-		if _, ok := remainMallocStatMap[v.StackHash]; ok {
-			remainMallocStatMap[v.StackHash].Count += 1
-			remainMallocStatMap[v.StackHash].Byte += v.Byte
+		if !inReportSizeClass(v.StackId, v.Byte) {
+			continue
+		}
+		if _, ok := remainMallocStatMap[v.StackId]; ok {
+			remainMallocStatMap[v.StackId].Count += v.weight()
+			remainMallocStatMap[v.StackId].Byte += v.weightedByte()
 		} else {
-			remainMallocStatMap[v.StackHash] = &MallocStat{
-				Byte:  v.Byte,
-				Count: 1,
-				Stack: v.Stack,
+			remainMallocStatMap[v.StackId] = &MallocStat{
+				Kind:    v.Kind,
+				Byte:    v.weightedByte(),
+				Count:   v.weight(),
+				StackId: v.StackId,
 			}
 		}
 	}
@@ -122,14 +303,164 @@ func prepareData() {
 		return mallocTopCountAfterFreeSlice[i].Count > mallocTopCountAfterFreeSlice[j].Count
 	})
 
-	prepareMenu()
+	for _, v := range mallocTopByteSlice {
+		if v.Kind.family() == familyNew {
+			newTopByteSlice = append(newTopByteSlice, v)
+		} else if v.Kind.family() == familyNewArray {
+			newArrayTopByteSlice = append(newArrayTopByteSlice, v)
+		}
+	}
+	for _, v := range mallocTopCountSlice {
+		if v.Kind.family() == familyNew {
+			newTopCountSlice = append(newTopCountSlice, v)
+		} else if v.Kind.family() == familyNewArray {
+			newArrayTopCountSlice = append(newArrayTopCountSlice, v)
+		}
+	}
+
+	for _, v := range mismatchStatMap {
+		mismatchSlice = append(mismatchSlice, *v)
+	}
+	sort.SliceStable(mismatchSlice, func(i, j int) bool {
+		return mismatchSlice[i].Count > mismatchSlice[j].Count
+	})
 }
 
 func prepareMenu() {
-	MenuDescriptionSlice = append(MenuDescriptionSlice, "Top Byte [malloc]")
-	MenuDescriptionSlice = append(MenuDescriptionSlice, "Top Count [malloc]")
-	MenuDescriptionSlice = append(MenuDescriptionSlice, "Top Byte [malloc after free]")
-	MenuDescriptionSlice = append(MenuDescriptionSlice, "Top Count [malloc after free]")
+	menuItemSlice = nil
+	menuItemSlice = append(menuItemSlice, menuItem{"Top Byte [malloc]", "Byte", mallocStatRows(mallocTopByteSlice, true)})
+	menuItemSlice = append(menuItemSlice, menuItem{"Top Count [malloc]", "Count", mallocStatRows(mallocTopCountSlice, false)})
+	menuItemSlice = append(menuItemSlice, menuItem{"Top Byte [malloc after free]", "Byte", mallocStatRows(mallocTopByteAfterFreeSlice, true)})
+	menuItemSlice = append(menuItemSlice, menuItem{"Top Count [malloc after free]", "Count", mallocStatRows(mallocTopCountAfterFreeSlice, false)})
+	menuItemSlice = append(menuItemSlice, menuItem{"Top Byte [new]", "Byte", mallocStatRows(newTopByteSlice, true)})
+	menuItemSlice = append(menuItemSlice, menuItem{"Top Count [new]", "Count", mallocStatRows(newTopCountSlice, false)})
+	menuItemSlice = append(menuItemSlice, menuItem{"Top Byte [new[]]", "Byte", mallocStatRows(newArrayTopByteSlice, true)})
+	menuItemSlice = append(menuItemSlice, menuItem{"Top Count [new[]]", "Count", mallocStatRows(newArrayTopCountSlice, false)})
+	menuItemSlice = append(menuItemSlice, menuItem{"Mismatch [alloc/free]", "Count", mismatchRows(mismatchSlice)})
+	menuItemSlice = append(menuItemSlice, menuItem{"Size Classes [malloc]", "Count", sizeClassRows()})
+	menuItemSlice = append(menuItemSlice, menuItem{"Top Churn [short-lived]", "Count", churnRows()})
+	menuItemSlice = append(menuItemSlice, menuItem{"Leak Suspects [score]", "Score", leakSuspectRows(rankLeakSuspects(mallocTopByteAfterFreeSlice))})
+	if len(trackTimeline) > 0 {
+		menuItemSlice = append(menuItemSlice, menuItem{"Heap Growth [live bytes]", "Byte", growthRows(mallocTopByteAfterFreeSlice)})
+	}
+	if len(threadMallocStatMap) > 0 {
+		menuItemSlice = append(menuItemSlice, menuItem{"Threads [malloc]", "Byte", threadRows()})
+	}
+	if len(trackSnapshots) > 1 {
+		menuItemSlice = append(menuItemSlice, menuItem{"Snapshot Growth [live bytes]", "Delta Byte", snapshotGrowthRows()})
+	}
+	if len(loadTrackHeader.Sources) > 0 {
+		menuItemSlice = append(menuItemSlice, menuItem{"Sources [merged]", "Byte", sourceRows()})
+	}
+}
+
+func mallocStatRows(slice []MallocStat, byByte bool) []mainRow {
+	var rows []mainRow
+	for _, elem := range slice {
+		value := strconv.FormatInt(elem.Count, 10)
+		if byByte {
+			value = strconv.FormatInt(elem.Byte, 10)
+		}
+		detail := append(sizeDetail(elem.StackId), lifetimeDetail(elem.StackId)...)
+		detail = append(detail, sourceDetail(elem.StackId)...)
+		rows = append(rows, mainRow{Value: value, Stack: getStack(elem.StackId), StackId: elem.StackId, Detail: detail})
+	}
+	return rows
+}
+
+// sourceDetail splits the statistics of the stack by source in merged
+// track files.
+func sourceDetail(stackId uint32) []string {
+	if len(loadTrackHeader.Sources) == 0 {
+		return nil
+	}
+	if sourceLiveStatMap == nil {
+		sourceLiveStatMap = make(map[sourceStack]*SourceMallocStat)
+		for _, op := range remainMallocOpMap {
+			key := sourceStack{op.Source, op.StackId}
+			if _, ok := sourceLiveStatMap[key]; !ok {
+				sourceLiveStatMap[key] = &SourceMallocStat{Source: op.Source, StackId: op.StackId}
+			}
+			sourceLiveStatMap[key].Count += op.weight()
+			sourceLiveStatMap[key].Byte += op.weightedByte()
+		}
+	}
+	list := sourceMallocStatMap[stackId]
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Source < list[j].Source
+	})
+	detail := []string{"Sources:"}
+	for _, v := range list {
+		line := fmt.Sprintf("  [%d] %s: %d times %d bytes", v.Source, sourcePath(v.Source), v.Count, v.Byte)
+		if l, ok := sourceLiveStatMap[sourceStack{v.Source, stackId}]; ok {
+			line += fmt.Sprintf(", live %d blocks %d bytes", l.Count, l.Byte)
+		}
+		detail = append(detail, line)
+	}
+	return append(detail, "")
+}
+
+func sourcePath(source uint16) string {
+	if int(source) < len(loadTrackHeader.Sources) {
+		return loadTrackHeader.Sources[source].Path
+	}
+	return "?"
+}
+
+func sourceRows() []mainRow {
+	var rows []mainRow
+	for _, source := range buildReportSources() {
+		rows = append(rows, mainRow{
+			Title: fmt.Sprintf("[%d] %s", source.Index, source.Track.Path),
+			Value: strconv.FormatInt(source.Totals.LiveBytes, 10),
+			Detail: []string{
+				fmt.Sprintf("path: %s", source.Track.Path),
+				fmt.Sprintf("exe: %s pid: %d host: %s tracer: %s", source.Track.Exe, source.Track.Pid, source.Track.Host, source.Track.Tracer),
+				fmt.Sprintf("start: %s", source.Track.StartTime),
+				fmt.Sprintf("alloc: %d times %d bytes", source.Totals.AllocCount, source.Totals.AllocBytes),
+				fmt.Sprintf("live: %d blocks %d bytes", source.Totals.LiveCount, source.Totals.LiveBytes),
+			},
+		})
+	}
+	return rows
+}
+
+// growthRows starts with the whole heap, followed by the stacks still
+// holding memory.
+func growthRows(slice []MallocStat) []mainRow {
+	var liveByte int64
+	for _, op := range remainMallocOpMap {
+		liveByte += op.weightedByte()
+	}
+	rows := []mainRow{{Title: "[all live allocations]", Value: strconv.FormatInt(liveByte, 10), Chart: true}}
+	for _, row := range mallocStatRows(slice, true) {
+		row.Chart = true
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func mismatchRows(slice []MismatchStat) []mainRow {
+	var rows []mainRow
+	for _, elem := range slice {
+		row := mainRow{
+			Title: fmt.Sprintf("%s -> %s", elem.MallocKind, elem.FreeKind),
+			Value: strconv.FormatInt(elem.Count, 10),
+		}
+		row.Detail = append(row.Detail, fmt.Sprintf("%s by %s, %d times, %d bytes", elem.MallocKind, elem.FreeKind, elem.Count, elem.Byte))
+		row.Detail = append(row.Detail, "", fmt.Sprintf("%s stack:", elem.MallocKind))
+		for index, frame := range getStack(elem.MallocStackId) {
+			translateStack, _ := translateStackString(frame)
+			row.Detail = append(row.Detail, fmt.Sprintf("[%d] %s", index, translateStack))
+		}
+		row.Detail = append(row.Detail, "", fmt.Sprintf("%s stack:", elem.FreeKind))
+		for index, frame := range getStack(elem.FreeStackId) {
+			translateStack, _ := translateStackString(frame)
+			row.Detail = append(row.Detail, fmt.Sprintf("[%d] %s", index, translateStack))
+		}
+		rows = append(rows, row)
+	}
+	return rows
 }
 
 func initViews(g *gocui.Gui) error {
@@ -218,11 +549,60 @@ func quitReportUI(g *gocui.Gui, v *gocui.View) error {
 	return gocui.ErrQuit
 }
 
+// keySnapshot writes a checkpoint of the live statistics to the track file.
+func keySnapshot(g *gocui.Gui, v *gocui.View) error {
+	memStatMutex.Lock()
+	err := SnapshotSave()
+	memStatMutex.Unlock()
+	mainV, _ := g.View(Main)
+	if err != nil {
+		mainV.Title = fmt.Sprintf("Main Window [snapshot error: %v]", err)
+	} else {
+		mainV.Title = fmt.Sprintf("Main Window [snapshot at %s]", time.Now().Format("15:04:05"))
+	}
+	return nil
+}
+
+// keySwitchPid replays the timeline of the next recorded process, after
+// the last one it goes back to all the processes.
+func keySwitchPid(g *gocui.Gui, v *gocui.View) error {
+	pids := timelinePids()
+	next := pids[0]
+	for i, pid := range pids {
+		if pid == timelinePid {
+			next = 0
+			if i+1 < len(pids) {
+				next = pids[i+1]
+			}
+		}
+	}
+	from, to := timelineRange()
+	err := ReplayTimeRange(from, to, next)
+	mainV, _ := g.View(Main)
+	if err != nil {
+		mainV.Title = fmt.Sprintf("Main Window [switch error: %v]", err)
+		return nil
+	}
+	mainV.Title = "Main Window"
+	prepareData()
+	prepareMenu()
+	clampSelection()
+	drawMenuView(g)
+	drawMainView(g)
+	drawDetailView(g)
+	return nil
+}
+
 func drawMenuView(g *gocui.Gui) {
 	menuV, _ := g.View(Menu)
 	menuV.Clear()
-	for _, v := range MenuDescriptionSlice {
-		_, _ = fmt.Fprintln(menuV, v)
+	if !liveStartTime.IsZero() {
+		menuV.Title = fmt.Sprintf("Menu [live %s, s: snapshot]", time.Since(liveStartTime).Round(time.Second))
+	} else if len(timelinePids()) > 1 {
+		menuV.Title = fmt.Sprintf("Menu [%s, p: switch]", pidTitle(timelinePid))
+	}
+	for _, v := range menuItemSlice {
+		_, _ = fmt.Fprintln(menuV, v.Description)
 	}
 	_ = menuV.SetCursor(0, menuSelectIndex)
 }
@@ -234,46 +614,18 @@ func drawMainView(g *gocui.Gui) {
 	_, _ = fmt.Fprintf(mainV, "%s\n", getMainViewHeader())
 
 	updateMainViewWindowSize(g)
-	if menuSelectIndex == MallocTopByte {
-		for index := mainViewWindowMin; index <= mainViewWindowMax; index++ {
-			if index < 0 || index >= len(mallocTopByteSlice) {
-				continue
-			}
-			elem := mallocTopByteSlice[index]
-			translateStack, _ := translateStackString(elem.Stack[0])
-			str := expandStyleString(translateStack, MainFunctionWidth, strconv.FormatInt(elem.Byte, 10))
-			_, _ = fmt.Fprintf(mainV, "[%d] %s\n", index, str)
-		}
-	} else if menuSelectIndex == MallocTopCount {
-		for index := mainViewWindowMin; index <= mainViewWindowMax; index++ {
-			if index < 0 || index >= len(mallocTopCountSlice) {
-				continue
-			}
-			elem := mallocTopCountSlice[index]
-			translateStack, _ := translateStackString(elem.Stack[0])
-			str := expandStyleString(translateStack, MainFunctionWidth, strconv.FormatInt(int64(elem.Count), 10))
-			_, _ = fmt.Fprintf(mainV, "[%d] %s\n", index, str)
+	rows := getMainViewRows()
+	for index := mainViewWindowMin; index <= mainViewWindowMax; index++ {
+		if index < 0 || index >= len(rows) {
+			continue
 		}
-	} else if menuSelectIndex == MallocTopByteAfterFree {
-		for index := mainViewWindowMin; index <= mainViewWindowMax; index++ {
-			if index < 0 || index >= len(mallocTopByteAfterFreeSlice) {
-				continue
-			}
-			elem := mallocTopByteAfterFreeSlice[index]
-			translateStack, _ := translateStackString(elem.Stack[0])
-			str := expandStyleString(translateStack, MainFunctionWidth, strconv.FormatInt(elem.Byte, 10))
-			_, _ = fmt.Fprintf(mainV, "[%d] %s\n", index, str)
-		}
-	} else if menuSelectIndex == MallocTopCountAfterFree {
-		for index := mainViewWindowMin; index <= mainViewWindowMax; index++ {
-			if index < 0 || index >= len(mallocTopCountAfterFreeSlice) {
-				continue
-			}
-			elem := mallocTopCountAfterFreeSlice[index]
-			translateStack, _ := translateStackString(elem.Stack[0])
-			str := expandStyleString(translateStack, MainFunctionWidth, strconv.FormatInt(int64(elem.Count), 10))
-			_, _ = fmt.Fprintf(mainV, "[%d] %s\n", index, str)
+		elem := rows[index]
+		title := elem.Title
+		if len(title) == 0 && len(elem.Stack) > 0 {
+			title, _ = translateStackString(elem.Stack[0])
 		}
+		str := expandStyleString(title, MainFunctionWidth, elem.Value)
+		_, _ = fmt.Fprintf(mainV, "[%d] %s\n", index, str)
 	}
 	_ = mainV.SetCursor(0, mainSelectIndex-mainViewWindowMin+1)
 }
@@ -294,39 +646,126 @@ func updateMainViewWindowSize(g *gocui.Gui) {
 }
 
 func getMainViewHeader() string {
-	if menuSelectIndex == MallocTopByte || menuSelectIndex == MallocTopByteAfterFree {
-		return expandStyleString("Function", MainFunctionWidth+4, "Byte")
-	} else if menuSelectIndex == MallocTopCount || menuSelectIndex == MallocTopCountAfterFree {
-		return expandStyleString("Function", MainFunctionWidth+4, "Count")
+	if menuSelectIndex < 0 || menuSelectIndex >= len(menuItemSlice) {
+		return ""
 	}
-	return ""
+	return expandStyleString("Function", MainFunctionWidth+4, menuItemSlice[menuSelectIndex].ValueName)
 }
 
-func getMainViewSlice() []MallocStat {
-	if menuSelectIndex == MallocTopByte {
-		return mallocTopByteSlice
-	} else if menuSelectIndex == MallocTopCount {
-		return mallocTopCountSlice
-	} else if menuSelectIndex == MallocTopByteAfterFree {
-		return mallocTopByteAfterFreeSlice
-	} else if menuSelectIndex == MallocTopCountAfterFree {
-		return mallocTopCountAfterFreeSlice
+func getMainViewRows() []mainRow {
+	if menuSelectIndex < 0 || menuSelectIndex >= len(menuItemSlice) {
+		return nil
 	}
-	return nil
+	return menuItemSlice[menuSelectIndex].Rows
 }
 
 func drawDetailView(g *gocui.Gui) {
 	detailV, _ := g.View(Detail)
 	detailV.Clear()
-	mainSlice := getMainViewSlice()
-	if mainSlice != nil {
-		for index, elem := range mainSlice[mainSelectIndex].Stack {
-			translateStack, _ := translateStackString(elem)
-			_, _ = fmt.Fprintf(detailV, "[%d] %s\n", index, translateStack)
+	rows := getMainViewRows()
+	if mainSelectIndex < 0 || mainSelectIndex >= len(rows) {
+		return
+	}
+	if rows[mainSelectIndex].Chart || (rows[mainSelectIndex].StackId != 0 && len(trackTimeline) > 0) {
+		drawGrowthChart(detailV, rows[mainSelectIndex].StackId)
+	}
+	for _, line := range rows[mainSelectIndex].Detail {
+		_, _ = fmt.Fprintln(detailV, line)
+	}
+	for index, elem := range rows[mainSelectIndex].Stack {
+		translateStack, _ := translateStackString(elem)
+		_, _ = fmt.Fprintf(detailV, "[%d] %s\n", index, translateStack)
+	}
+}
+
+// drawGrowthChart plots the live bytes and the live count over the
+// reported time window, filling the width of the view.
+func drawGrowthChart(v *gocui.View, stackId uint32) {
+	width, height := v.Size()
+	series, err := computeGrowthSeries(width-ChartAxisWidth-1, stackId)
+	if err != nil {
+		_, _ = fmt.Fprintf(v, "%v\n\n", err)
+		return
+	}
+	chartHeight := (height - 12) / 2
+	if chartHeight < 3 {
+		chartHeight = 3
+	}
+
+	if stackId != 0 {
+		_, _ = fmt.Fprintln(v, "Live bytes (# selected stack, . others)")
+		drawChart(v, chartHeight, series.Bytes, '.', series.StackBytes, '#', formatByteSize)
+	} else {
+		_, _ = fmt.Fprintln(v, "Live bytes")
+		drawChart(v, chartHeight, series.Bytes, '#', nil, 0, formatByteSize)
+	}
+	drawChartTimeAxis(v, len(series.Bytes), series.From, series.To)
+	_, _ = fmt.Fprintln(v, "Live count")
+	drawChart(v, chartHeight, series.Count, '#', nil, 0, func(n int64) string {
+		return strconv.FormatInt(n, 10)
+	})
+	drawChartTimeAxis(v, len(series.Count), series.From, series.To)
+}
+
+// drawChart draws one column per value, scaled to height rows. The
+// overlay values are drawn with their own mark at the bottom of the
+// columns, they must not exceed the series values.
+func drawChart(w io.Writer, height int, series []int64, mark byte, overlay []int64, overlayMark byte, formatValue func(int64) string) {
+	var max int64 = 1
+	for _, value := range series {
+		if value > max {
+			max = value
+		}
+	}
+	level := func(value int64) int {
+		return int((value*int64(height) + max - 1) / max)
+	}
+
+	line := make([]byte, len(series))
+	for row := height - 1; row >= 0; row-- {
+		for i, value := range series {
+			line[i] = ' '
+			if overlay != nil && level(overlay[i]) > row {
+				line[i] = overlayMark
+			} else if level(value) > row {
+				line[i] = mark
+			}
+		}
+		label := ""
+		if row == height-1 {
+			label = formatValue(max)
+		} else if row == 0 {
+			label = formatValue(0)
 		}
+		_, _ = fmt.Fprintf(w, "%*s|%s\n", ChartAxisWidth, label, line)
 	}
 }
 
+func drawChartTimeAxis(w io.Writer, width int, from int64, to int64) {
+	_, _ = fmt.Fprintf(w, "%*s+%s\n", ChartAxisWidth, "", strings.Repeat("-", width))
+	start := timelineStartTime()
+	fromLabel := time.Duration(from - start).Round(time.Millisecond).String()
+	toLabel := time.Duration(to - start).Round(time.Millisecond).String()
+	padding := width - len(fromLabel) - len(toLabel)
+	if padding < 1 {
+		padding = 1
+	}
+	_, _ = fmt.Fprintf(w, "%*s %s%s%s\n\n", ChartAxisWidth, "", fromLabel, strings.Repeat(" ", padding), toLabel)
+}
+
+func formatByteSize(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%dB", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(b)/float64(div), "KMGTPE"[exp])
+}
+
 func keyArrowUp(g *gocui.Gui, v *gocui.View) error {
 	if v.Name() == Menu {
 		if menuSelectIndex > 0 {
@@ -348,7 +787,7 @@ func keyArrowUp(g *gocui.Gui, v *gocui.View) error {
 
 func keyArrowDown(g *gocui.Gui, v *gocui.View) error {
 	if v.Name() == Menu {
-		if menuSelectIndex < len(MenuDescriptionSlice)-1 {
+		if menuSelectIndex < len(menuItemSlice)-1 {
 			menuSelectIndex++
 			mainSelectIndex = 0
 			drawMenuView(g)
@@ -356,7 +795,7 @@ func keyArrowDown(g *gocui.Gui, v *gocui.View) error {
 			drawDetailView(g)
 		}
 	} else if v.Name() == Main {
-		if mainSelectIndex < len(getMainViewSlice())-1 {
+		if mainSelectIndex < len(getMainViewRows())-1 {
 			mainSelectIndex++
 			drawMainView(g)
 			drawDetailView(g)
@@ -396,19 +835,29 @@ func expandStyleString(s1 string, s1width int, s2 string) string {
 }
 
 func translateStackString(rawStack string) (string, error) {
+	fileLine, funcName, moduleName, err := splitStackString(rawStack)
+	if err != nil {
+		return rawStack, err
+	}
+
+	simplifyModuleName, _ := simplifyModuleName(moduleName)
+	filtFuncName, _ := cppFiltFuncName(funcName)
+
+	return fmt.Sprintf("%s [%s] [%s]", filtFuncName, fileLine, simplifyModuleName), nil
+}
+
+// splitStackString splits a "addr : func+off/size [module]" frame, the
+// module keeps its brackets.
+func splitStackString(rawStack string) (string, string, string, error) {
 	index1 := strings.Index(rawStack, " : ")
 	index2 := strings.Index(rawStack, "[")
 	if index1 <= 0 || index2 <= 0 || index1 >= index2 {
-		return rawStack, fmt.Errorf("translate stack split args error: %s", rawStack)
+		return "", "", "", fmt.Errorf("translate stack split args error: %s", rawStack)
 	}
 	fileLine := strings.TrimSpace(rawStack[:index1])
 	funcName := strings.TrimSpace(rawStack[index1+3 : index2])
 	moduleName := strings.TrimSpace(rawStack[index2:])
-
-	simplifyModuleName, _ := simplifyModuleName(moduleName)
-	filtFuncName, _ := cppFiltFuncName(funcName)
-
-	return fmt.Sprintf("%s [%s] [%s]", filtFuncName, fileLine, simplifyModuleName), nil
+	return fileLine, funcName, moduleName, nil
 }
 
 func simplifyModuleName(rawName string) (string, error) {
@@ -431,10 +880,11 @@ func cppFiltFuncName(rawName string) (string, error) {
 		return elem, nil
 	}
 
-	cmd := fmt.Sprintf("c++filt %s", funcName)
-	filtName, err := RunShellCommand(cmd)
+	// the frame names come from track files, no shell sees them and "--"
+	// keeps a name from being an option
+	filtName, err := RunCommand("c++filt", "--", funcName)
 	if err != nil {
-		return rawName, fmt.Errorf("cppfilt name run shell err: %v", err)
+		return rawName, fmt.Errorf("cppfilt name run err: %v", err)
 	}
 	filtName = strings.TrimSuffix(filtName, "\n")
 	cppfiltCacheMap[funcName] = filtName